@@ -0,0 +1,245 @@
+package fp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Symbology is the Fingerprint name of a barcode type as used by BARSET
+type Symbology string
+
+const (
+	Code128         Symbology = "CODE128"
+	EAN13           Symbology = "EAN13"
+	EAN8            Symbology = "EAN8"
+	UPCA            Symbology = "UPCA"
+	Code39          Symbology = "CODE39"
+	Interleaved2of5 Symbology = "INT2OF5"
+	QRCode          Symbology = "QRCODE"
+	DataMatrix      Symbology = "DATAMATRIX"
+	PDF417          Symbology = "PDF417"
+)
+
+var (
+	ErrInvalidBarcode = errors.New("invalid barcode")
+)
+
+// TwoD reports whether s is a matrix / stacked symbology
+func (s Symbology) TwoD() bool {
+	switch s {
+	case QRCode, DataMatrix, PDF417:
+		return true
+	}
+
+	return false
+}
+
+// Barcode describes a barcode field, zero values use the defaults noted
+type Barcode struct {
+	Type Symbology
+	Data string
+
+	// wide to narrow element ratio; 3:1 if zero, ignored by fixed ratio
+	// and 2D symbologies
+	RatioLarge, RatioSmall int
+
+	// width of the narrowest element / module in dots; 2 if zero
+	Enlargement int
+
+	// bar height in dots; 100 if zero, ignored by QR Code and DataMatrix
+	Height int
+
+	// error correction; PDF417 0-8, QR Code 1-4 (L, M, Q, H);
+	// zero is the printers default
+	SecurityLevel int
+
+	// print the data in human readable form below the bars
+	HumanReadable bool
+}
+
+// Validate checks the data and parameters of b against its symbology
+func (b *Barcode) Validate() error {
+	d := b.Data
+	if len(d) == 0 {
+		return b.err("no data")
+	}
+
+	if b.RatioLarge < 0 || b.RatioSmall < 0 || b.Enlargement < 0 || b.Height < 0 {
+		return b.err("negative dimension")
+	}
+
+	switch b.Type {
+	case EAN13:
+		return b.checkGTIN(12)
+
+	case EAN8:
+		return b.checkGTIN(7)
+
+	case UPCA:
+		return b.checkGTIN(11)
+
+	case Code39:
+		for _, c := range d {
+			if !strings.ContainsRune(code39Chars, c) {
+				return b.err("invalid character %q", c)
+			}
+		}
+
+	case Interleaved2of5:
+		if !allDigits(d) {
+			return b.err("only digits allowed")
+		}
+
+		if len(d)%2 != 0 {
+			return b.err("needs an even number of digits")
+		}
+
+	case Code128:
+		for _, c := range d {
+			if c > 127 {
+				return b.err("invalid character %q", c)
+			}
+		}
+
+	case QRCode:
+		if b.SecurityLevel < 0 || b.SecurityLevel > 4 {
+			return b.err("security level has to be 1-4")
+		}
+
+		if max := capacity(d, 7089, 4296, 2953); len(d) > max {
+			return b.err("data too long, %d > %d", len(d), max)
+		}
+
+	case DataMatrix:
+		if max := capacity(d, 3116, 2335, 1556); len(d) > max {
+			return b.err("data too long, %d > %d", len(d), max)
+		}
+
+	case PDF417:
+		if b.SecurityLevel < 0 || b.SecurityLevel > 8 {
+			return b.err("security level has to be 0-8")
+		}
+
+		if max := capacity(d, 2710, 1850, 1108); len(d) > max {
+			return b.err("data too long, %d > %d", len(d), max)
+		}
+
+	default:
+		return b.err("unknown symbology")
+	}
+
+	if b.SecurityLevel != 0 && b.Type != QRCode && b.Type != PDF417 {
+		return b.err("security level not supported")
+	}
+
+	return nil
+}
+
+// BARSET "<type>",<ratio large>,<ratio small>,<enlargement>,<height>[,<security>]
+// BARFONT ON|OFF
+// PRBAR "<data>"
+func (b *Barcode) statement() string {
+	return fmt.Sprintf("%s:BARFONT %s:PRBAR %s",
+		b.barset(), T(b.HumanReadable, "ON", "OFF"), Quote(b.Data))
+}
+
+func (b *Barcode) barset() string {
+	s := fmt.Sprintf("BARSET %s,%d,%d,%d,%d", Quote(string(b.Type)),
+		orDefault(b.RatioLarge, 3), orDefault(b.RatioSmall, 1),
+		orDefault(b.Enlargement, 2), orDefault(b.Height, 100))
+
+	if b.SecurityLevel != 0 {
+		s += fmt.Sprintf(",%d", b.SecurityLevel)
+	}
+
+	return s
+}
+
+// PrintBarcode validates b and adds it to the canvas at the current position
+func (p *Printer) PrintBarcode(b *Barcode) (err error) {
+	return p.PrintBarcodeContext(context.Background(), b)
+}
+
+func (p *Printer) PrintBarcodeContext(ctx context.Context, b *Barcode) (err error) {
+	err = b.Validate()
+	if err != nil {
+		return
+	}
+
+	_, err = p.ExecContext(ctx, b.statement())
+	return
+}
+
+func (b *Barcode) err(format string, a ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidBarcode, b.Type, fmt.Sprintf(format, a...))
+}
+
+// EAN / UPC: digits without or with a valid check digit
+func (b *Barcode) checkGTIN(n int) error {
+	d := b.Data
+	if !allDigits(d) {
+		return b.err("only digits allowed")
+	}
+
+	switch len(d) {
+	case n:
+		return nil
+
+	case n + 1:
+		if c := gtinCheckDigit(d[:n]); c != d[n] {
+			return b.err("invalid check digit %c, expected %c", d[n], c)
+		}
+
+		return nil
+	}
+
+	return b.err("needs %d or %d digits", n, n+1)
+}
+
+// GS1 mod 10 check digit
+func gtinCheckDigit(d string) byte {
+	var sum int
+	for i := 0; i < len(d); i++ {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 0 {
+			n *= 3
+		}
+
+		sum += n
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+const code39Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ-. $/+%"
+
+// capacity of a 2D symbology for the densest mode d fits into
+func capacity(d string, numeric, alnum, bytes int) int {
+	if allDigits(d) {
+		return numeric
+	}
+
+	for _, c := range d {
+		if !strings.ContainsRune(code39Chars, c) && c != ':' {
+			return bytes
+		}
+	}
+
+	return alnum
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func orDefault(v, def int) int {
+	return T(v == 0, def, v)
+}
@@ -0,0 +1,333 @@
+package fp
+
+import (
+	"github.com/rileys-trash-can/libfp/prbuf"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// resolution assumed when none is known, most Fingerprint printers have 203dpi
+const DefaultDPI = 203
+
+// canvas is a software rendition of the printers print buffer used for
+// previews. It uses the printers coordinate system, the origin is in the
+// lower left corner and y grows upwards. Fonts and barcodes are
+// approximated, the result shows layout, not exact glyphs or scannable codes.
+type canvas struct {
+	img *image.Gray
+	dpi int
+
+	pos     image.Point
+	dir     Direction
+	align   Align
+	inverse bool
+
+	font       string
+	size       int
+	slant      int
+	magx, magy int
+}
+
+func newCanvas(size image.Point, dpi int) *canvas {
+	c := &canvas{
+		img: image.NewGray(image.Rectangle{Max: size}),
+		dpi: T(dpi > 0, dpi, DefaultDPI),
+	}
+
+	c.clear()
+	c.reset()
+
+	return c
+}
+
+// limit is the longest side of the canvas, larger sizes do not fit and
+// would only use up memory
+func (c *canvas) limit() int {
+	s := c.img.Rect.Size()
+	return max(s.X, s.Y)
+}
+
+// maxPRBUF is the size of the largest PRBUF of an image of the canvas, with
+// every dot its own run
+func (c *canvas) maxPRBUF() int {
+	s := c.img.Rect.Size()
+	return 6 + (s.X+1)*s.Y
+}
+
+// CLL
+func (c *canvas) clear() {
+	draw.Draw(c.img, c.img.Bounds(), image.White, image.Point{}, draw.Src)
+}
+
+// state after power up
+func (c *canvas) reset() {
+	c.pos = image.Point{}
+	c.dir = DirLeftToRight
+	c.align = AlignBottomLeft
+	c.inverse = false
+
+	c.font = DefaultFont
+	c.size = 12
+	c.slant = 0
+	c.magx, c.magy = 1, 1
+}
+
+func (c *canvas) style(s *TextStyle) {
+	c.font = T(s.Font == "", DefaultFont, s.Font)
+	c.size = orDefault(s.Size, 12)
+	c.slant = s.Slant
+	c.magx, c.magy = orDefault(s.MagX, 1), orDefault(s.MagY, 1)
+	c.dir = Direction(orDefault(int(s.Direction), int(DirLeftToRight)))
+	c.align = Align(orDefault(int(s.Align), int(AlignBottomLeft)))
+	c.inverse = s.Inverse
+}
+
+// PRTXT
+func (c *canvas) text(s string) {
+	c.place(c.textMask(s), c.inverse)
+}
+
+// PRLINE
+func (c *canvas) line(length, thickness int) {
+	m := image.NewAlpha(image.Rect(0, 0, length, thickness))
+	draw.Draw(m, m.Bounds(), image.Opaque, image.Point{}, draw.Src)
+
+	c.place(m, false)
+}
+
+// PRBOX
+func (c *canvas) box(width, height, thickness, radius int) {
+	m := image.NewAlpha(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			inner := inRoundRect(x-thickness, y-thickness,
+				width-2*thickness, height-2*thickness, max(radius-thickness, 0))
+
+			if inRoundRect(x, y, width, height, radius) && !inner {
+				m.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+	}
+
+	c.place(m, false)
+}
+
+// PRBAR
+func (c *canvas) barcode(b *Barcode) {
+	c.place(c.barcodeMask(b), false)
+}
+
+// the bars are a placeholder derived from the data
+func (c *canvas) barcodeMask(b *Barcode) (m *image.Alpha) {
+	enl := orDefault(b.Enlargement, 2)
+	height := orDefault(b.Height, 100)
+	h := fnv.New64a()
+	h.Write([]byte(b.Data))
+	seed := h.Sum64()
+
+	if b.Type.TwoD() {
+		side := int(math.Ceil(math.Sqrt(float64(len(b.Data)*8)))) + 2
+		side = max(side, 10)
+
+		cols := T(b.Type == PDF417, side*3, side)
+		rows := T(b.Type == PDF417, (side+2)/3, side)
+
+		m = image.NewAlpha(image.Rect(0, 0, cols*enl, rows*enl))
+		for my := 0; my < rows; my++ {
+			for mx := 0; mx < cols; mx++ {
+				frame := mx == 0 || my == rows-1 || (b.Type != DataMatrix && (my == 0 || mx == cols-1))
+				if frame || (seed>>uint((mx*7+my*13)%64))&1 == 1 {
+					fillAlpha(m, image.Rect(mx*enl, my*enl, (mx+1)*enl, (my+1)*enl))
+				}
+			}
+		}
+	} else {
+		// start and stop guards around 8 modules per byte
+		modules := []bool{true, false, true}
+		for _, d := range []byte(b.Data) {
+			for bit := 7; bit >= 0; bit-- {
+				modules = append(modules, (d^byte(seed))>>uint(bit)&1 == 1)
+			}
+		}
+
+		modules = append(modules, true, false, true)
+
+		m = image.NewAlpha(image.Rect(0, 0, len(modules)*enl, height))
+		for i, bar := range modules {
+			if bar {
+				fillAlpha(m, image.Rect(i*enl, 0, (i+1)*enl, height))
+			}
+		}
+	}
+
+	if b.HumanReadable {
+		txt := c.textMask(b.Data)
+		tb := txt.Bounds()
+		mb := m.Bounds()
+
+		both := image.NewAlpha(image.Rect(0, 0, max(mb.Dx(), tb.Dx()), mb.Dy()+tb.Dy()))
+		draw.Draw(both, mb, m, image.Point{}, draw.Src)
+		draw.Draw(both, tb.Add(image.Pt(0, mb.Dy())), txt, image.Point{}, draw.Src)
+
+		m = both
+	}
+
+	return
+}
+
+// PRBUF, pixels prbuf.IsDark reports are printed
+func (c *canvas) bitmap(img image.Image) {
+	b := img.Bounds()
+	m := image.NewAlpha(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			if prbuf.IsDark(img.At(b.Min.X+x, b.Min.Y+y)) {
+				m.SetAlpha(x, y, color.Alpha{0xff})
+			}
+		}
+	}
+
+	c.place(m, c.inverse)
+}
+
+// text rendered with a builtin font scaled to the font size and MAG
+func (c *canvas) textMask(s string) *image.Alpha {
+	face := basicfont.Face7x13
+
+	d := &font.Drawer{Face: face}
+	w := d.MeasureString(s).Ceil()
+	m := image.NewAlpha(image.Rect(0, 0, max(w, 1), face.Height))
+
+	d.Dst = m
+	d.Src = image.Opaque
+	d.Dot = fixed.P(0, face.Ascent)
+	d.DrawString(s)
+
+	// point size to dots
+	scale := float64(c.size) * float64(c.dpi) / 72 / float64(face.Height)
+
+	return scaleAlpha(m, scale*float64(c.magx), scale*float64(c.magy), c.slant)
+}
+
+// fieldRect returns the area a w x h field occupies when placed with the
+// current position, direction and alignment; in printer coordinates
+func (c *canvas) fieldRect(w, h int) (r image.Rectangle) {
+	ax, ay := c.anchor(w, h)
+
+	for i, p := range [][2]int{{0, 0}, {w - 1, 0}, {0, h - 1}, {w - 1, h - 1}} {
+		x, y := c.rotate(p[0]-ax, p[1]-ay)
+		px := image.Rect(c.pos.X+x, c.pos.Y+y, c.pos.X+x+1, c.pos.Y+y+1)
+
+		if i == 0 {
+			r = px
+		} else {
+			r = r.Union(px)
+		}
+	}
+
+	return
+}
+
+// draws mask m (upright, y down) rotated by direction, aligned to the
+// insertion point; inverse fills the fields area and clears the mask
+func (c *canvas) place(m *image.Alpha, inverse bool) {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	ax, ay := c.anchor(w, h)
+
+	for ly := 0; ly < h; ly++ {
+		for lx := 0; lx < w; lx++ {
+			set := m.AlphaAt(b.Min.X+lx, b.Min.Y+ly).A >= 0x80
+			if !set && !inverse {
+				continue
+			}
+
+			// field coordinates, y up
+			x, y := c.rotate(lx-ax, h-1-ly-ay)
+			c.set(c.pos.X+x, c.pos.Y+y, set != inverse)
+		}
+	}
+}
+
+func (c *canvas) set(x, y int, black bool) {
+	c.img.SetGray(x, c.img.Rect.Dy()-1-y, color.Gray{Y: T[uint8](black, 0, 0xff)})
+}
+
+// insertion point in field coordinates
+func (c *canvas) anchor(w, h int) (x, y int) {
+	a := int(c.align) - 1
+	col, row := a%3, a/3
+
+	return col * w / 2, row * h / 2
+}
+
+func (c *canvas) rotate(x, y int) (int, int) {
+	switch c.dir {
+	case DirTopToBottom:
+		return y, -x
+
+	case DirRightToLeft:
+		return -x, -y
+
+	case DirBottomToTop:
+		return -y, x
+	}
+
+	return x, y
+}
+
+// nearest neighbour scale with a horizontal shear of slant degrees
+func scaleAlpha(src *image.Alpha, sx, sy float64, slant int) *image.Alpha {
+	b := src.Bounds()
+	w := max(int(math.Round(float64(b.Dx())*sx)), 1)
+	h := max(int(math.Round(float64(b.Dy())*sy)), 1)
+
+	shear := math.Tan(float64(slant) * math.Pi / 180)
+	extra := int(math.Ceil(math.Abs(shear) * float64(h)))
+
+	dst := image.NewAlpha(image.Rect(0, 0, w+extra, h))
+	for y := 0; y < h; y++ {
+		off := int(shear * float64(h-1-y))
+		if shear < 0 {
+			off += extra
+		}
+
+		for x := 0; x < w; x++ {
+			a := src.AlphaAt(b.Min.X+int(float64(x)/sx), b.Min.Y+int(float64(y)/sy))
+			dst.SetAlpha(x+off, y, a)
+		}
+	}
+
+	return dst
+}
+
+func inRoundRect(x, y, w, h, r int) bool {
+	if x < 0 || y < 0 || x >= w || y >= h {
+		return false
+	}
+
+	r = min(r, w/2, h/2)
+	if r <= 0 {
+		return true
+	}
+
+	// distance to the nearest corner centre
+	cx := min(max(x, r), w-1-r)
+	cy := min(max(y, r), h-1-r)
+	dx, dy := x-cx, y-cy
+
+	return dx*dx+dy*dy <= r*r
+}
+
+func fillAlpha(m *image.Alpha, r image.Rectangle) {
+	draw.Draw(m, r, image.Opaque, image.Point{}, draw.Src)
+}
@@ -35,6 +35,8 @@ func OpenPrinter(args []string) *fp.Printer {
 		log.Fatalf("Invaid connection type '%s', choose between 'net' and 'serial'", ctype)
 	}
 
+	p.Timeout = *OptTimeout
+
 	if *OptBeep {
 		err := p.Beep(fp.Sound{Freq: 850, Dur: 200}, fp.Sound{Freq: 950, Dur: 200})
 		if err != nil {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/rileys-trash-can/libfp"
+	"github.com/rileys-trash-can/libfp/fptemplate"
 	"github.com/rileys-trash-can/libfp/prbuf"
 
 	// image stuffs
@@ -13,11 +14,17 @@ import (
 	"image"
 
 	"bufio"
+	"context"
 	_ "embed"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
 var (
@@ -26,14 +33,22 @@ var (
 
 	PrinterAddressType = flag.String("ctype", os.Getenv("IPL_CTYPE"), "Specify printer connection type, can also be set by env IPL_CTYPE")
 
-	OptBeep = flag.Bool("beep", true, "toggle connection-beep")
+	OptBeep    = flag.Bool("beep", true, "toggle connection-beep")
+	OptTimeout = flag.Duration("timeout", 30*time.Second, "timeout for each command sent to the printer, 0 disables")
 
-	OptDither     = flag.Bool("dither", true, "toggle dither when sending images")
-	OptColorspace = flag.Bool("map-colorspace", true, "toggle colorspace conversion when sending images (only w/o dither)")
+	OptDither  = flag.String("dither", "none", "dither images before printing or encoding, see help")
+	OptFilters = flag.String("filters", "", "filter images before dithering, e.g. autolevels,gamma=1.2,threshold=0.6, see help")
 
-	OptResize = flag.String("resize", "fit", "set resize mode for images 'fit' or 'off'")
-	OptPFC    = flag.Uint("count", 1, "amout of printfeeds / labels to print")
-	OptDOPF   = flag.Bool("dopf", true, "enable or disable printfeed")
+	OptPFC  = flag.Uint("count", 1, "amout of printfeeds / labels to print")
+	OptDOPF = flag.Bool("dopf", true, "enable or disable printfeed")
+
+	OptSize = flag.String("size", "816x1201", "label size in dots used by preview, <width>x<height>")
+
+	OptLabel  = flag.String("label", "", "rasterize images to this label size in dots, <width>x<height>, empty keeps the image size")
+	OptFit    = flag.String("fit", "shrink", "scale images to the label: none, shrink, contain, cover or stretch")
+	OptRotate = flag.String("rotate", "none", "rotate images: none, auto, 90, 180 or 270 (clockwise)")
+	OptAlign  = flag.String("align", "start,start", "place images on the label: <h>,<v> each start, center or end")
+	OptMargin = flag.Int("margin", 0, "white margin around images in dots")
 )
 
 func main() {
@@ -127,7 +142,11 @@ func main() {
 
 		defer out.Close()
 
-		prbuf.Encode(img, out)
+		err = prbuf.Encode(img, out)
+		if err != nil {
+			log.Fatalf("Failed to encode %s: %s", outfile, err)
+		}
+
 		log.Printf("done.")
 
 	case "decodeprbuf":
@@ -193,8 +212,8 @@ func main() {
 		}
 
 		res, err = printer.ReadResponse()
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+		if err != nil {
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 		*/
 
@@ -210,18 +229,7 @@ func main() {
 			os.Exit(1)
 		}
 
-		// 		conv := ipl.ImageConverter{
-		// 			Dither:        *OptDither,
-		// 			MapColorspace: *OptColorspace, // only works when dither is not set
-		//
-		// 			Resize: Resize(*OptResize),
-		// 		}
-
 		img := ReadImage(args[1])
-		// b, err := conv.Convert(img) // fix sometime
-		//if err != nil {
-		//	log.Fatalf("Failed to convert image: %s", err)
-		//}
 
 		printer := OpenPrinter(args)
 
@@ -252,9 +260,9 @@ func main() {
 			log.Fatalf("Failed to directimg: %s", err)
 		}
 
-		res, err := printer.ReadResponse()
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+		_, err = printer.ReadResponse()
+		if err != nil {
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 
 		// play audio over http lul
@@ -264,19 +272,15 @@ func main() {
 		}
 
 		res, err = printer.ReadResponse()
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+		if err != nil {
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 		*/
 
 		log.Printf("sent data for printing...")
 		err = printer.PF(*OptPFC)
 		if err != nil {
-			return
-		}
-
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 
 	case "printprbuf":
@@ -285,13 +289,6 @@ func main() {
 			os.Exit(1)
 		}
 
-		// 		conv := ipl.ImageConverter{
-		// 			Dither:        *OptDither,
-		// 			MapColorspace: *OptColorspace, // only works when dither is not set
-		//
-		// 			Resize: Resize(*OptResize),
-		// 		}
-
 		log.Printf("Reading File %s", args[1])
 		in, err := os.ReadFile(args[1])
 		if err != nil {
@@ -314,9 +311,9 @@ func main() {
 			return
 		}
 
-		res, err := printer.ReadResponse()
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+		_, err = printer.ReadResponse()
+		if err != nil {
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 
 		// send imagesize
@@ -325,9 +322,9 @@ func main() {
 			log.Fatalf("Failed to directPRBUF: %s", err)
 		}
 
-		res, err = printer.ReadResponse()
-		if err != nil && res.Status != "Ok" {
-			log.Fatalf("Failed to readresponse: %s: %s", err, res.Status)
+		_, err = printer.ReadResponse()
+		if err != nil {
+			log.Fatalf("Failed to readresponse: %s", err)
 		}
 		log.Printf("sent data for printing...")
 
@@ -344,20 +341,6 @@ func main() {
 			os.Exit(1)
 		}
 
-		/*
-			conv := fp.ImageConverter{
-				Dither:        *OptDither,
-				MapColorspace: *OptColorspace, // only works when dither is not set
-
-				Resize: Resize(*OptResize),
-			}
-
-			img := ReadImage(args[2])
-			b, err := conv.Convert(img)
-			if err != nil {
-				log.Fatalf("Failed to convert image: %s", err)
-			}
-		*/
 		b, err := os.ReadFile(args[2])
 		if err != nil {
 			log.Fatalf("Failed to read img: %s", err)
@@ -378,6 +361,97 @@ func main() {
 
 		log.Printf("res: %s", res)
 
+	case "discover":
+		if len(args) < 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if *OptTimeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), *OptTimeout)
+		}
+
+		defer cancel()
+
+		log.Printf("scanning %s", args[1])
+		found, err := fp.Discover(ctx, args[1])
+		if err != nil {
+			log.Printf("Failed to scan: %s", err)
+		}
+
+		for _, f := range found {
+			fmt.Printf("%s\t%s\t%s\n", f.Addr, f.Model, f.Firmware)
+		}
+
+		log.Printf("found %d printers", len(found))
+
+	case "probe":
+		printer := OpenPrinter(args)
+
+		c, err := printer.Probe()
+		if err != nil {
+			log.Fatalf("Failed to probe printer: %s", err)
+		}
+
+		fmt.Printf("model:    %s\nfirmware: %s\ndpi:      %d\nwidth:    %d dots\nlength:   %d dots\nmemory:   %d bytes free on tmp:\n",
+			c.Model, c.Firmware, c.DPI, c.Width, c.Length, c.FreeMemory)
+
+	case "preview":
+		if len(args) < 3 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		Preview(args[1], args[2])
+
+	case "template":
+		if len(args) < 4 {
+			flag.Usage()
+			os.Exit(1)
+		}
+
+		l := ReadTemplate(args[2], args[3])
+
+		switch args[1] {
+		case "render":
+			// program to stdout or preview
+			if len(args) < 5 {
+				err := l.WriteProgram(os.Stdout)
+				if err != nil {
+					log.Fatalf("Failed to write program: %s", err)
+				}
+
+				return
+			}
+
+			out, err := os.Create(args[4])
+			if err != nil {
+				log.Fatalf("Failed to create %s: %s", args[4], err)
+			}
+
+			defer out.Close()
+
+			err = png.Encode(out, l.Render())
+			if err != nil {
+				log.Fatalf("Failed to encode preview: %s", err)
+			}
+
+		case "print":
+			printer := OpenPrinter(args)
+
+			err := printer.PrintLabel(l, T(*OptDOPF, *OptPFC, 0))
+			if err != nil {
+				log.Fatalf("Failed to print label: %s", err)
+			}
+
+			log.Printf("printed.")
+
+		default:
+			flag.Usage()
+			os.Exit(1)
+		}
+
 	case "help":
 		log.Printf(Usage)
 	default:
@@ -403,21 +477,157 @@ func ReadImage(name string) (i image.Image) {
 
 	log.Printf("Decoded image in %s format", fm)
 
+	i, err = Rasterizer().Rasterize(i)
+	if err != nil {
+		log.Fatalf("Failed to rasterize '%s': %s", name, err)
+	}
+
 	return
 }
 
-func Resize(r string) fp.Resize {
-	switch r {
-	case "off":
-		return fp.ResizeOff
-	case "fit":
-		return fp.ResizeFit
+// Rasterizer returns the rasterizer configured by the flags
+func Rasterizer() *fp.Rasterizer {
+	r := &fp.Rasterizer{
+		Margins: fp.Margin(*OptMargin),
+		Step: func(step string) {
+			log.Printf("Rasterizing: %s", step)
+		},
+	}
 
-	default:
-		log.Fatalf("--resize has to be one of 'off' and 'fit'")
+	if *OptLabel != "" {
+		_, err := fmt.Sscanf(*OptLabel, "%dx%d", &r.LabelSize.X, &r.LabelSize.Y)
+		if err != nil {
+			log.Fatalf("Invalid --label '%s': %s", *OptLabel, err)
+		}
+	}
+
+	r.Fit = Choice("--fit", *OptFit, map[string]fp.Fit{
+		"none": fp.FitNone, "shrink": fp.FitShrink, "contain": fp.FitContain,
+		"cover": fp.FitCover, "stretch": fp.FitStretch,
+	})
+
+	r.Rotate = Choice("--rotate", *OptRotate, map[string]fp.Rotation{
+		"none": fp.RotateNone, "auto": fp.RotateAuto,
+		"90": fp.Rotate90, "180": fp.Rotate180, "270": fp.Rotate270,
+	})
+
+	places := map[string]fp.Placement{"start": fp.PlaceStart, "center": fp.PlaceCenter, "end": fp.PlaceEnd}
+	h, v, _ := strings.Cut(*OptAlign, ",")
+	r.AlignH = Choice("--align", h, places)
+	r.AlignV = Choice("--align", T(v == "", h, v), places)
+
+	fs, err := fp.ParseFilters(*OptFilters)
+	if err != nil {
+		log.Fatalf("Invalid --filters: %s", err)
+	}
+
+	if len(fs) > 0 {
+		r.Filter = fs
+	}
+
+	// --dither used to be a bool
+	dname := *OptDither
+	switch dname {
+	case "false":
+		dname = "none"
+	case "true":
+		dname = "bayer8"
+	}
+
+	r.Dither, err = fp.DitherFromString(dname)
+	if err != nil {
+		log.Fatalf("Invalid --dither: %s", err)
+	}
+
+	return r
+}
+
+// Choice looks up the value of flag name in m
+func Choice[K any](name, value string, m map[string]K) K {
+	v, ok := m[value]
+	if !ok {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+		log.Fatalf("Invalid %s '%s', one of %s", name, value, strings.Join(keys, ", "))
+	}
+
+	return v
+}
+
+// renders the program in file to out, every label fed gets its own file
+func Preview(file, out string) {
+	var size image.Point
+	_, err := fmt.Sscanf(*OptSize, "%dx%d", &size.X, &size.Y)
+	if err != nil {
+		log.Fatalf("Invalid --size '%s': %s", *OptSize, err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %s", file, err)
+	}
+
+	defer f.Close()
+
+	in := fp.NewInterpreter(size, 0)
+	err = in.Run(f)
+	if err != nil {
+		log.Printf("Warning: %s", err)
+	}
+
+	labels := in.Labels()
+	if len(labels) == 0 {
+		log.Printf("no label fed, writing canvas")
+		labels = append(labels, in.Canvas())
+	}
+
+	ext := filepath.Ext(out)
+	for i, l := range labels {
+		name := T(i == 0, out, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(out, ext), i+1, ext))
+
+		o, err := os.Create(name)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %s", name, err)
+		}
+
+		err = png.Encode(o, l)
+		o.Close()
+		if err != nil {
+			log.Fatalf("Failed to encode %s: %s", name, err)
+		}
+
+		log.Printf("wrote %s", name)
+	}
+}
+
+// executes template tpl with the JSON in data
+func ReadTemplate(tpl, data string) *fp.Label {
+	t, err := fptemplate.Load(tpl)
+	if err != nil {
+		log.Fatalf("Failed to load template: %s", err)
+	}
+
+	d, err := os.ReadFile(data)
+	if err != nil {
+		log.Fatalf("Failed to read data '%s': %s", data, err)
+	}
+
+	var v any
+	err = json.Unmarshal(d, &v)
+	if err != nil {
+		log.Fatalf("Failed to decode data '%s': %s", data, err)
+	}
+
+	l, err := t.Execute(v)
+	if err != nil {
+		log.Fatalf("Failed to execute template: %s", err)
 	}
 
-	return 0
+	return l
 }
 
 func T[K any](c bool, a, b K) (r K) {
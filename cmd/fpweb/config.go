@@ -21,7 +21,7 @@ var (
 
 	OptVerbose = flag.Bool("verbose", false, "toggle verbose logging")
 	OptBeep    = flag.Bool("beep", true, "toggle connection-beep")
-	OptDryRun  = flag.Bool("dry-run", false, "disables connection to printer; for testing")
+	OptDryRun  = flag.Bool("dry-run", false, "replaces the printer with an in-process mock; for testing")
 
 	OptSupportMusic = flag.Bool("music-support", false, "enables music while printing")
 )
@@ -31,11 +31,35 @@ type Config struct {
 	PrinterPort  string `yaml:"printer.port"`
 	PrinterCType string `yaml:"printer.type"`
 
+	// per round-trip timeout, PF gets one timeout per label
+	PrinterTimeout time.Duration `yaml:"printer.timeout"`
+
+	// printers jobs are routed to by name, the first one is the default;
+	// if empty the printer.* keys and flags configure one named "default"
+	Printers []PrinterConfig `yaml:"printers"`
+
 	Listen        string `yaml:"listen"`
-	MaxPrintCount uint   `yaml:"maxpfcount"`
+	MaxPrintCount uint   `yaml:"maxpfcount"` // per job of users that are not admins, 0 lifts the limit
 	DB            string `yaml:"databasepath"`
 	DBType        string `yaml:"dbtype"`
 
+	// directory of label templates printable by name
+	Templates string `yaml:"templates"`
+
+	// everyone is an admin without logging in, like before there were users
+	AuthDisabled bool `yaml:"auth.disabled"`
+
+	// labels per user, 0 is unlimited; admins have no quota
+	QuotaDaily   uint `yaml:"quota.daily"`
+	QuotaMonthly uint `yaml:"quota.monthly"`
+
+	// highest priority users can give their jobs, admins are not limited
+	MaxPriority int `yaml:"priority.max"`
+
+	// print requests per minute and user, api token or address; 0 is off
+	RateLimit int `yaml:"ratelimit.perminute"`
+	RateBurst int `yaml:"ratelimit.burst"` // defaults to perminute
+
 	MusicMinPF       int           `yaml:"music.minpf"`
 	MusicIntWait     time.Duration `yaml:"music.intwait"`
 	MusicContPlaying time.Duration `yaml:"music.contplaying"`
@@ -46,6 +70,20 @@ type Config struct {
 	SSHAddr string `yaml:"ssh.addr"`
 }
 
+type PrinterConfig struct {
+	Name string `yaml:"name"`
+	Host string `yaml:"host"` // net address with port
+	Port string `yaml:"port"` // serial device
+	Type string `yaml:"type"` // net / serial
+
+	Timeout time.Duration `yaml:"timeout"`
+
+	// label size in dots and resolution, probed if zero
+	Width  int `yaml:"width"`
+	Height int `yaml:"height"`
+	DPI    int `yaml:"dpi"`
+}
+
 var config *Config
 var configOnce sync.Once
 
@@ -65,7 +65,8 @@ func updateImage(uuid uuid.UUID, b []byte) error {
 }
 
 func GetImage(uuid uuid.UUID) (i Image) {
-	GetDB().First(&i, uuid)
+	// Image has no primary key, First(&i, uuid) would compare Created
+	GetDB().Where("uuid = ?", uuid).First(&i)
 
 	return
 }
@@ -85,6 +86,15 @@ func openDB() {
 			log.Fatalf("Failed to open db: %s", err)
 		}
 
+		// status updates and print workers write concurrently, sqlite
+		// fails with SQLITE_BUSY instead of waiting for the lock
+		sqldb, err := db.DB()
+		if err != nil {
+			log.Fatalf("Failed to open db: %s", err)
+		}
+
+		sqldb.SetMaxOpenConns(1)
+
 	case "mysql":
 		db, err = gorm.Open(mysql.Open(conf.DB), &gorm.Config{})
 		if err != nil {
@@ -95,7 +105,7 @@ func openDB() {
 		log.Fatalf("Invalid DBType: sqlite or mysql is valid")
 	}
 
-	err = db.AutoMigrate(&Image{})
+	err = db.AutoMigrate(&Image{}, &Job{}, &User{}, &Token{}, &Usage{})
 	if err != nil {
 		log.Fatalf("Failed to AutoMigrate: %s", err)
 	}
@@ -105,6 +115,7 @@ type Image struct {
 	Created time.Time
 
 	UUID        uuid.UUID
+	Owner       uint       `gorm:"index"` // User.ID, 0 if uploaded before auth
 	UnProcessed *uuid.UUID // unprocessed counterpart
 	Processed   *uuid.UUID // processed counterpart
 
@@ -151,8 +162,7 @@ func encodeImage(w io.Writer, img image.Image, fmt string) (err error) {
 		return bmp.Encode(w, img)
 
 	case "prbuf":
-		prbuf.Encode(img, w)
-		return nil
+		return prbuf.Encode(img, w)
 	}
 
 	return errors.New("Unknown Image Format")
@@ -5,8 +5,10 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/rileys-trash-can/libfp"
 	"image"
 	"io"
 	"log"
@@ -35,7 +37,7 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 
 	enc := json.NewEncoder(w)
 
-	db := GetDB().Model(&Image{})
+	db := visibleImages(GetDB().Model(&Image{}), CurrentUser(r))
 
 	if optall {
 		var length int
@@ -43,7 +45,7 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 
 		db.Select("count(1)").Find(&length)
 		db = db.Select("UUID", "UnProcessed", "Processed",
-			"IsProcessed", "Ext", "Public", "Name")
+			"IsProcessed", "Ext", "Public", "Name", "Owner")
 
 		if len(processed) > 0 {
 			db = db.Where("is_processed", processedType)
@@ -63,21 +65,21 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		if len(offsetstr) == 0 || len(limitstr) == 0 {
-			panic("Invalid or missing offset or limit!")
+			panic(httpErrorf(400, "Invalid or missing offset or limit!"))
 		}
 
 		offset, err := strconv.ParseUint(offsetstr[0], 10, 31)
 		if err != nil {
-			panic(err)
+			panic(httpErrorf(400, "Invalid offset: %s", err))
 		}
 
 		limit, err := strconv.ParseUint(limitstr[0], 10, 31)
 		if err != nil {
-			panic(err)
+			panic(httpErrorf(400, "Invalid limit: %s", err))
 		}
 
 		if limit > 100 {
-			panic("Invalid limit; limit > 100")
+			panic(httpErrorf(400, "Invalid limit; limit > 100"))
 		}
 
 		var length int
@@ -89,7 +91,7 @@ func handleList(w http.ResponseWriter, r *http.Request) {
 			Total:  length,
 		}
 		db.Select("UUID", "UnProcessed", "Processed",
-			"IsProcessed", "Ext", "Public", "Name").Offset(int(offset)).Limit(int(limit)).Find(&l.Images)
+			"IsProcessed", "Ext", "Public", "Name", "Owner").Offset(int(offset)).Limit(int(limit)).Find(&l.Images)
 
 		err = enc.Encode(&l)
 		if err != nil {
@@ -104,17 +106,17 @@ func handleJobAPI(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := vars["uuid"]
 	if !ok {
-		panic("no id specified")
+		panic(httpErrorf(400, "no id specified"))
 	}
 
 	uid, err := uuid.Parse(id)
 	if err != nil {
-		panic(err)
+		panic(httpErrorf(400, "Invalid job id: %s", err))
 	}
 
 	status := GetStatus(uid)
-	if status == nil {
-		panic("Invalid Status")
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(404, "job not found"))
 	}
 
 	w.WriteHeader(200)
@@ -131,18 +133,82 @@ func handleJobAPI(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleJobEvents streams the status of a job as server-sent events until
+// it is done
+func handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json") // until streaming
+
+	uid, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		panic(httpErrorf(400, "Invalid job id: %s", err))
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		panic(httpErrorf(500, "streaming not supported"))
+	}
+
+	// subscribe first to not miss an update
+	ch := SubscribeStatus(uid)
+	defer UnsubscribeStatus(uid, ch)
+
+	status := GetStatus(uid)
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(404, "job not found"))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	log.Printf("[GET] /api/job/%s/events", uid)
+
+	// keeps proxies from closing idle streams
+	ping := time.NewTicker(time.Second * 15)
+	defer ping.Stop()
+
+	send := func(s *Status) {
+		b, err := json.Marshal(s)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Fprintf(w, "data: %s\n\n", b)
+		flusher.Flush()
+	}
+
+	send(status)
+	for !status.Done {
+		select {
+		case status, ok = <-ch:
+			if !ok { // fell behind, the client reconnects
+				return
+			}
+
+			send(status)
+
+		case <-ping.C:
+			fmt.Fprintf(w, ": ping\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 func handleGetImg(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "image/png")
 
 	v := mux.Vars(r)
 	t, ok := v["uuid"]
 	if !ok {
-		panic("no UUID")
+		panic(httpErrorf(400, "no UUID"))
 	}
 
 	uid, err := uuid.Parse(t)
 	if err != nil {
-		panic(err)
+		panic(httpErrorf(400, "Invalid image id: %s", err))
 	}
 
 	if *OptVerbose {
@@ -150,6 +216,9 @@ func handleGetImg(w http.ResponseWriter, r *http.Request) {
 	}
 
 	img := GetImage(uid)
+	if img.UUID != uid || !CurrentUser(r).CanView(&img) {
+		panic(httpErrorf(404, "image not found"))
+	}
 
 	w.Write(img.Data)
 }
@@ -159,35 +228,25 @@ type PrintJobID struct {
 }
 
 func handlePrint(w http.ResponseWriter, r *http.Request) {
-	uid := uuid.New()
-	newImageCh <- uid
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-
-	e := json.NewEncoder(w)
-	e.Encode(&PrintJobID{
-		uid,
-	})
-
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid File Upload: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-
-		return
+		panic(httpErrorf(400, "Invalid File Upload: %s", err))
 	}
 
+	owner := CurrentUser(r).ID
+
 	log.Printf("[POST] received image file; size: %d bytes", len(data))
 
 	q := r.URL.Query()
 
+	pr := GetPrinter(first(q["printer"], ""))
+	if pr == nil {
+		panic(httpErrorf(400, "Unknown Printer: %s", q["printer"][0]))
+	}
+
 	job := &PrintJob{
-		UUID: uid,
+		owner: owner,
+		token: tokenID(r),
 
 		public:     len(q["public"]) > 0,
 		optresize:  len(q["resize"]) > 0,
@@ -201,84 +260,71 @@ func handlePrint(w http.ResponseWriter, r *http.Request) {
 	dname := ""
 	dnames := q["dither"]
 
-	log.Printf("%+v", q)
 	if len(dnames) > 0 {
 		dname = dnames[0]
 	}
 
-	job.ditherer = DitherFromString(dname)
+	job.dither = dname
 
 	job.PFCount = 1
 	pfs := q["pf"]
 	if len(pfs) > 0 {
 		i, err := strconv.ParseUint(pfs[0], 10, 32)
-		job.PFCount = uint(i)
 		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Invalid PF Count: " + err.Error(),
-				Progress: -1,
-				Done:     true,
-			}
+			panic(httpErrorf(400, "Invalid PF Count: %s", err))
+		}
 
-			return
+		job.PFCount = uint(i)
+	}
+
+	if len(q["priority"]) > 0 {
+		job.Priority, err = strconv.Atoi(q["priority"][0])
+		if err != nil {
+			panic(httpErrorf(400, "Invalid Priority: %s", err))
 		}
 	}
 
+	job.filters = q.Get("filters")
+	_, err = fp.ParseFilters(job.filters)
+	if err != nil {
+		panic(httpErrorf(400, "Invalid Filters: %s", err))
+	}
+
 	sizexs, sizeys := q["x"], q["y"]
-	if len(sizexs) == 0 || len(sizeys) == 0 {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "No Size of Label Specified",
-			Progress: -1,
-			Done:     true,
-		}
+	if size, ok := pr.LabelSize(); ok && len(sizexs) == 0 && len(sizeys) == 0 {
+		sizexs, sizeys = []string{strconv.Itoa(size.X)}, []string{strconv.Itoa(size.Y)}
+	}
 
-		return
+	if len(sizexs) == 0 || len(sizeys) == 0 {
+		panic(httpErrorf(400, "No Size of Label Specified"))
 	}
 
 	x64, err := strconv.ParseUint(sizexs[0], 10, 31)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid width: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-		return
+		panic(httpErrorf(400, "Invalid width: %s", err))
 	}
 
 	y64, err := strconv.ParseUint(sizeys[0], 10, 31)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid height: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-		return
+		panic(httpErrorf(400, "Invalid height: %s", err))
 	}
 
 	job.LabelSize = image.Pt(int(x64), int(y64))
+	err = pr.checkLabelSize(job.LabelSize)
+	if err != nil {
+		panic(httpErrorf(400, "%s", err))
+	}
 
 	// image handeling
 	imgcfg, imgfmt, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Failed to Decode Image (header): " + err.Error(),
-				Progress: -1,
-				Done:     true,
-			}
-
-			return
-		}
+		panic(httpErrorf(415, "Failed to Decode Image (header): %s", err))
 	}
 
 	job.UnprocessedImage = Image{
 		UUID: uuid.New(),
 
+		Owner:       owner,
 		IsProcessed: false,
 		Ext:         imgfmt,
 		Data:        data,
@@ -289,21 +335,155 @@ func handlePrint(w http.ResponseWriter, r *http.Request) {
 
 	GetDB().Create(&job.UnprocessedImage)
 
-	select {
-	case printQ <- job:
-		break
+	job.UUID = uuid.New()
+	newImageCh <- StatusNew{job.UUID, owner}
 
-	default:
+	err = pr.Enqueue(job)
+	if err != nil {
 		imageUpdateCh <- Status{
-			UUID: uid,
+			UUID: job.UUID,
 
-			Step:     "print queue full",
+			Step:     "Failed to queue job: " + err.Error(),
 			Progress: -1,
 			Done:     true,
 		}
+
+		panic(httpErrorf(queueErrorCode(err), "Failed to queue job: %s", err))
 	}
 
 	log.Printf("[POST] Received %s Image with bounds: %d x %d", imgfmt, imgcfg.Width, imgcfg.Height)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+
+	e := json.NewEncoder(w)
+	e.Encode(&PrintJobID{
+		job.UUID,
+	})
+}
+
+func handleJobCancel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		panic(httpErrorf(400, "Invalid job id: %s", err))
+	}
+
+	status := GetStatus(uid)
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(404, "job not found"))
+	}
+
+	err = CancelJob(uid)
+	if err != nil {
+		panic(httpErrorf(409, "%s", err))
+	}
+
+	log.Printf("[DELETE] cancelled job %s", uid)
+
+	err = json.NewEncoder(w).Encode(&PrintJobID{uid})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handleJobPriority(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uid, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		panic(httpErrorf(400, "Invalid job id: %s", err))
+	}
+
+	priority, err := strconv.Atoi(r.URL.Query().Get("priority"))
+	if err != nil {
+		panic(httpErrorf(400, "Invalid Priority: %s", err))
+	}
+
+	status := GetStatus(uid)
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(404, "job not found"))
+	}
+
+	err = SetJobPriority(CurrentUser(r), uid, priority)
+	if err != nil {
+		panic(httpErrorf(409, "%s", err))
+	}
+
+	err = json.NewEncoder(w).Encode(&PrintJobID{uid})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type QueueInfo struct {
+	Paused bool        `json:"paused"`
+	Jobs   []QueuedJob `json:"jobs"`
+}
+
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	jobs, err := Queue(CurrentUser(r))
+	if err != nil {
+		panic(err)
+	}
+
+	err = json.NewEncoder(w).Encode(&QueueInfo{
+		Paused: queuePaused.Load(),
+		Jobs:   jobs,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// handleQueuePause returns a handler pausing or resuming all printers
+func handleQueuePause(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		PauseQueue(pause)
+		log.Printf("[POST] queue paused: %t", pause)
+
+		handleQueue(w, r)
+	}
+}
+
+func handlePrinterInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := r.URL.Query().Get("printer")
+
+	pr := GetPrinter(name)
+	if pr == nil {
+		panic(httpErrorf(404, "unknown printer %s", name))
+	}
+
+	caps := pr.conn.Caps()
+	if caps == nil {
+		panic(httpErrorf(503, "printer was not probed"))
+	}
+
+	err := json.NewEncoder(w).Encode(caps)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handlePrinters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	infos := make([]*PrinterInfo, len(printers))
+	for i, pr := range printers {
+		infos[i] = pr.Info()
+	}
+
+	err := json.NewEncoder(w).Encode(infos)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func first[K any](a []K, b K) K {
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"net/http"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type AuthLevel int
+
+const (
+	AuthAny   AuthLevel = iota // the user is looked up if there are credentials
+	AuthUser                   // a user is required
+	AuthAdmin                  // an admin is required
+)
+
+type userKey struct{}
+type tokenKey struct{}
+
+// RequireAuth looks up the user of a request from a bearer token, basic auth
+// or the session cookie and rejects it if it is below level
+func RequireAuth(level AuthLevel, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, t, wait := authenticate(r)
+
+		switch {
+		case wait > 0:
+			secs := int(math.Ceil(wait.Seconds()))
+
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			deny(w, r, http.StatusTooManyRequests,
+				fmt.Sprintf("too many failed logins, retry in %ds", secs))
+			return
+
+		case level >= AuthUser && u == nil:
+			deny(w, r, http.StatusUnauthorized, "login required")
+			return
+
+		case level >= AuthAdmin && !u.Admin:
+			deny(w, r, http.StatusForbidden, "admin required")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey{}, u)
+		ctx = context.WithValue(ctx, tokenKey{}, t)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CurrentUser returns the user of a request passed through RequireAuth,
+// nil if not logged in
+func CurrentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey{}).(*User)
+
+	return u
+}
+
+// CurrentToken returns the api token or session a request was made with,
+// nil for passwords
+func CurrentToken(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenKey{}).(*Token)
+
+	return t
+}
+
+// wait is set if password logins from r are throttled
+func authenticate(r *http.Request) (u *User, t *Token, wait time.Duration) {
+	if GetConfig().AuthDisabled {
+		return anonymous, nil, 0
+	}
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		u, t = userByToken(strings.TrimPrefix(h, "Bearer "))
+		return
+	}
+
+	if name, password, ok := r.BasicAuth(); ok {
+		u, wait = checkLogin(r, name, password)
+		return
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		u, t = userByToken(c.Value)
+	}
+
+	return
+}
+
+// failed password logins per minute and address or user name, bcrypt alone
+// does not stop guessing
+const loginFailures, loginBurst = 5, 10
+
+var loginLimit = &ratelimit{buckets: make(map[string]*bucket)}
+
+// checkLogin returns the user if password is right; only failures count
+// against the limits, wait is set if r may not try now
+func checkLogin(r *http.Request, name, password string) (u *User, wait time.Duration) {
+	keys := []string{"addr:" + remoteHost(r), "user:" + name}
+
+	for _, k := range keys {
+		if ok, w := loginLimit.Peek(k, loginFailures, loginBurst); !ok {
+			wait = max(wait, w)
+		}
+	}
+
+	if wait > 0 {
+		log.Printf("[auth] throttled login as '%s' from %s", name, remoteHost(r))
+		return
+	}
+
+	u = userByPassword(name, password)
+	if u == nil {
+		for _, k := range keys {
+			loginLimit.Allow(k, loginFailures, loginBurst)
+		}
+	}
+
+	return
+}
+
+// browsers are sent to the login page, api clients get an error
+func deny(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	if code == http.StatusUnauthorized && !strings.HasPrefix(r.URL.Path, "/api") {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="fpweb"`)
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&ErrorRes{Error: msg})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+
+	u, wait := checkLogin(r, r.FormValue("user"), r.FormValue("password"))
+	if wait > 0 {
+		http.Redirect(w, r, "/login?failed=throttled&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	if u == nil {
+		log.Printf("[POST] failed login as '%s'", r.FormValue("user"))
+
+		http.Redirect(w, r, "/login?failed=1&next="+url.QueryEscape(next), http.StatusSeeOther)
+		return
+	}
+
+	secret, _, err := NewToken(u, "login from "+r.RemoteAddr, true, 0, 0)
+	if err != nil {
+		panic(err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    secret,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   r.TLS != nil,
+	})
+
+	log.Printf("[POST] %s logged in", u.Name)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		deleteSession(c.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   "/",
+		MaxAge: -1,
+	})
+
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(CurrentUser(r))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handlePassword(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	u := CurrentUser(r)
+	if u == anonymous {
+		panic(httpErrorf(400, "authentication is disabled"))
+	}
+
+	if !u.CheckPassword(r.FormValue("old")) {
+		panic(httpErrorf(403, "wrong password"))
+	}
+
+	err := u.SetPassword(r.FormValue("password"))
+	if err != nil {
+		panic(httpErrorf(400, "%s", err))
+	}
+
+	err = GetDB().Model(u).Update("hash", u.Hash).Error
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("[POST] %s changed their password", u.Name)
+
+	err = json.NewEncoder(w).Encode(u)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type NewTokenRes struct {
+	Token  string `json:"token"` // only shown once
+	Detail *Token `json:"detail"`
+}
+
+func handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	u := CurrentUser(r)
+	if u == anonymous {
+		panic(httpErrorf(400, "authentication is disabled"))
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		panic(httpErrorf(400, "no token name specified"))
+	}
+
+	var err error
+
+	var day, month uint64
+	if v := r.FormValue("day"); v != "" {
+		day, err = strconv.ParseUint(v, 10, 31)
+		if err != nil {
+			panic(httpErrorf(400, "Invalid daily quota: %s", err))
+		}
+	}
+
+	if v := r.FormValue("month"); v != "" {
+		month, err = strconv.ParseUint(v, 10, 31)
+		if err != nil {
+			panic(httpErrorf(400, "Invalid monthly quota: %s", err))
+		}
+	}
+
+	secret, t, err := NewToken(u, name, false, uint(day), uint(month))
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("[POST] %s created token '%s'", u.Name, name)
+
+	err = json.NewEncoder(w).Encode(&NewTokenRes{Token: secret, Detail: t})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	tokens, err := Tokens(CurrentUser(r))
+	if err != nil {
+		panic(err)
+	}
+
+	err = json.NewEncoder(w).Encode(tokens)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handleTokenDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 31)
+	if err != nil {
+		panic(httpErrorf(400, "Invalid token id: %s", err))
+	}
+
+	err = DeleteToken(CurrentUser(r), uint(id))
+	if err != nil {
+		panic(httpErrorf(404, "%s", err))
+	}
+
+	handleTokens(w, r)
+}
+
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	users, err := Users()
+	if err != nil {
+		panic(err)
+	}
+
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handleUserCreate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	u, err := CreateUser(r.FormValue("name"), r.FormValue("password"), BoolFromString(r.FormValue("admin")))
+	if err != nil {
+		panic(httpErrorf(400, "%s", err))
+	}
+
+	log.Printf("[POST] %s created user %s (admin: %t)", CurrentUser(r).Name, u.Name, u.Admin)
+
+	err = json.NewEncoder(w).Encode(u)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["name"]
+	if name == CurrentUser(r).Name {
+		panic(httpErrorf(400, "can not delete yourself"))
+	}
+
+	err := DeleteUser(name)
+	if err != nil {
+		panic(httpErrorf(404, "%s", err))
+	}
+
+	log.Printf("[DELETE] %s deleted user %s", CurrentUser(r).Name, name)
+
+	handleUsers(w, r)
+}
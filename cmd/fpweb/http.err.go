@@ -18,6 +18,20 @@ type errMiddleware struct {
 	next http.Handler
 }
 
+// HTTPError is panicked by handlers to answer with Code instead of 500
+type HTTPError struct {
+	Code int
+	Msg  string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Msg
+}
+
+func httpErrorf(code int, format string, a ...any) *HTTPError {
+	return &HTTPError{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
 type ErrorRes struct {
 	Error any `json:"error"`
 }
@@ -33,8 +47,13 @@ func (m *errMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		code := 500
+		if e, ok := err.(*HTTPError); ok {
+			code = e.Code
+		}
+
 		log.Printf("Error in %s request of '%s': %s", r.Method, r.URL.Path, err)
-		if *OptVerbose {
+		if *OptVerbose && code == 500 {
 			log.Print("stacktrace from panic: \n" + string(debug.Stack()))
 		}
 
@@ -42,7 +61,7 @@ func (m *errMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "application/json":
 			w.Header().Set("Location", "/")
 
-			w.WriteHeader(500)
+			w.WriteHeader(code)
 			enc := json.NewEncoder(w)
 			enc.Encode(&ErrorRes{
 				Error: err,
@@ -54,7 +73,7 @@ func (m *errMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			fallthrough
 
 		case "text/plain":
-			w.WriteHeader(500)
+			w.WriteHeader(code)
 			fmt.Fprintf(w, "There was an error handeling your request: %s\n return to / to do stuff", err)
 		}
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/rileys-trash-can/libfp"
 	"gorm.io/gorm/clause"
 	"io"
 	"io/fs"
@@ -34,17 +35,17 @@ func handleJob(w http.ResponseWriter, r *http.Request) {
 
 	id, ok := vars["uuid"]
 	if !ok {
-		panic("no id specified")
+		panic(httpErrorf(400, "no id specified"))
 	}
 
 	uid, err := uuid.Parse(id)
 	if err != nil {
-		panic(err)
+		panic(httpErrorf(400, "Invalid job id: %s", err))
 	}
 
 	status := GetStatus(uid)
-	if status == nil {
-		panic("Invalid Status // uid unknown")
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(404, "Invalid Status // uid unknown"))
 	}
 
 	err = tStatus.Execute(w, status)
@@ -54,36 +55,27 @@ func handleJob(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlePrintPOST(w http.ResponseWriter, r *http.Request) {
-	uid := uuid.New()
-	newImageCh <- uid
-
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(200)
-
-	fmt.Fprintf(w, `<head>
-	  <meta http-equiv="Refresh" content="0; URL=/job/%s" />
-	</head>`, uid)
+	owner := CurrentUser(r).ID
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid File Upload: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-
-		return
+		panic(httpErrorf(400, "Invalid File Upload: %s", err))
 	}
 
 	defer file.Close()
 
 	log.Printf("[POST] received image named '%s' sized %d bytes", header.Filename, header.Size)
 
+	pr := GetPrinter(r.FormValue("printer"))
+	if pr == nil {
+		panic(httpErrorf(400, "Unknown Printer: %s", r.FormValue("printer")))
+	}
+
 	job := &PrintJob{
-		UUID: uid,
+		owner: owner,
+		token: tokenID(r),
 
-		ditherer: DitherFromString(r.FormValue("dither")),
+		dither: r.FormValue("dither"),
 
 		public:     BoolFromString(r.FormValue("public")),
 		optresize:  BoolFromString(r.FormValue("resize")),
@@ -97,80 +89,60 @@ func handlePrintPOST(w http.ResponseWriter, r *http.Request) {
 	job.PFCount = 1
 	if len(r.Form["pf"]) > 0 {
 		i, err := strconv.ParseUint(r.FormValue("pf"), 10, 32)
+		if err != nil {
+			panic(httpErrorf(400, "Invalid PF Count: %s", err))
+		}
+
 		job.PFCount = uint(i)
+	}
+
+	if len(r.Form["priority"]) > 0 && r.FormValue("priority") != "" {
+		job.Priority, err = strconv.Atoi(r.FormValue("priority"))
 		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Invalid PF Count: " + err.Error(),
-				Progress: -1,
-				Done:     true,
-			}
-
-			return
+			panic(httpErrorf(400, "Invalid Priority: %s", err))
 		}
 	}
 
+	job.filters = r.FormValue("filters")
+	_, err = fp.ParseFilters(job.filters)
+	if err != nil {
+		panic(httpErrorf(400, "Invalid Filters: %s", err))
+	}
+
 	sizexs, sizeys := r.FormValue("x"), r.FormValue("y")
-	if len(sizexs) == 0 || len(sizeys) == 0 {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "No Size of Label Specified",
-			Progress: -1,
-			Done:     true,
-		}
+	if size, ok := pr.LabelSize(); ok && len(sizexs) == 0 && len(sizeys) == 0 {
+		sizexs, sizeys = strconv.Itoa(size.X), strconv.Itoa(size.Y)
+	}
 
-		return
+	if len(sizexs) == 0 || len(sizeys) == 0 {
+		panic(httpErrorf(400, "No Size of Label Specified"))
 	}
 
 	x64, err := strconv.ParseUint(sizexs, 10, 32)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid width: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-		return
+		panic(httpErrorf(400, "Invalid width: %s", err))
 	}
 
 	y64, err := strconv.ParseUint(sizeys, 10, 32)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid height: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-		return
+		panic(httpErrorf(400, "Invalid height: %s", err))
 	}
 
 	job.LabelSize = image.Pt(int(x64), int(y64))
+	err = pr.checkLabelSize(job.LabelSize)
+	if err != nil {
+		panic(httpErrorf(400, "%s", err))
+	}
 
 	// image handeling
 	data, err := io.ReadAll(file)
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Failed to Read Image: " + err.Error(),
-			Progress: -1,
-			Done:     true,
-		}
-
-		return
+		panic(httpErrorf(400, "Failed to Read Image: %s", err))
 	}
 
 	imgcfg, imgfmt, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Failed to Decode Image (header): " + err.Error(),
-				Progress: -1,
-				Done:     true,
-			}
-
-			return
-		}
+		panic(httpErrorf(415, "Failed to Decode Image (header): %s", err))
 	}
 
 	job.UnprocessedImage = Image{
@@ -179,6 +151,7 @@ func handlePrintPOST(w http.ResponseWriter, r *http.Request) {
 		IsProcessed: false,
 		Ext:         imgfmt,
 		Data:        data,
+		Owner:       owner,
 		Public:      job.public,
 		Name:        header.Filename,
 		Created:     time.Now(),
@@ -186,81 +159,73 @@ func handlePrintPOST(w http.ResponseWriter, r *http.Request) {
 
 	GetDB().Create(&job.UnprocessedImage)
 
-	select {
-	case printQ <- job:
-		break
+	job.UUID = uuid.New()
+	newImageCh <- StatusNew{job.UUID, owner}
 
-	default:
+	err = pr.Enqueue(job)
+	if err != nil {
 		imageUpdateCh <- Status{
-			UUID: uid,
+			UUID: job.UUID,
 
-			Step:     "print queue full",
+			Step:     "Failed to queue job: " + err.Error(),
 			Progress: -1,
 			Done:     true,
 		}
+
+		panic(httpErrorf(queueErrorCode(err), "Failed to queue job: %s", err))
 	}
-	log.Printf("[POST] Received Image in %s format bounds: %d x %d", imgfmt, imgcfg.Width, imgcfg.Height)
-}
 
-func handlePrintGET(w http.ResponseWriter, r *http.Request) {
-	uid := uuid.New()
-	newImageCh <- uid
+	log.Printf("[POST] Received Image in %s format bounds: %d x %d", imgfmt, imgcfg.Width, imgcfg.Height)
 
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(200)
 
 	fmt.Fprintf(w, `<head>
 	  <meta http-equiv="Refresh" content="0; URL=/job/%s" />
-	</head>`, uid)
+	</head>`, job.UUID)
+}
 
-	v := r.URL.Query()
+// handleReprint prints a stored image again, the arguments are form values
+func handleReprint(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		panic(httpErrorf(400, "Invalid form: %s", err))
+	}
 
-	if len(v["uuid"]) == 0 {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "No image UUID specified!",
-			Progress: -1,
-			Done:     true,
-		}
+	owner := CurrentUser(r).ID
+	v := r.Form
 
-		return
+	if len(v["uuid"]) == 0 {
+		panic(httpErrorf(400, "No image UUID specified!"))
 	}
 
-	uuid, err := uuid.Parse(v["uuid"][0])
+	id, err := uuid.Parse(v["uuid"][0])
 	if err != nil {
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "Invalid  UUID specified!",
-			Progress: -1,
-			Done:     true,
-		}
-
-		return
+		panic(httpErrorf(400, "Invalid UUID specified: %s", err))
 	}
 
 	var printfeeds uint = 1
 	if len(v["pf"]) > 0 {
 		pf, err := strconv.ParseUint(v["pf"][0], 10, 31)
 		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Invalid PF count specified!",
-				Progress: -1,
-				Done:     true,
-			}
-
-			return
+			panic(httpErrorf(400, "Invalid PF count specified: %s", err))
 		}
 
 		printfeeds = uint(pf)
 	}
 
-	log.Printf("[GET] reprint of image %s", uuid)
+	pr := GetPrinter(first(v["printer"], ""))
+	if pr == nil {
+		panic(httpErrorf(400, "Unknown Printer: %s", v["printer"][0]))
+	}
+
+	log.Printf("[POST] reprint of image %s on %s", id, pr.Name)
 
 	job := &PrintJob{
-		UUID: uid,
+		owner: owner,
+		token: tokenID(r),
 
-		ditherer: nil,
+		dither: "",
 
 		public:     false,
 		optresize:  false,
@@ -273,48 +238,49 @@ func handlePrintGET(w http.ResponseWriter, r *http.Request) {
 
 	job.PFCount = printfeeds
 
-	img := GetImage(uuid)
-	if img.UUID != uuid { // image not returned
-		imageUpdateCh <- Status{
-			UUID:     uid,
-			Step:     "image not found: " + err.Error(),
-			Progress: -1,
-			Done:     true,
+	if len(v["priority"]) > 0 {
+		job.Priority, err = strconv.Atoi(v["priority"][0])
+		if err != nil {
+			panic(httpErrorf(400, "Invalid Priority: %s", err))
 		}
+	}
 
-		return
+	img := GetImage(id)
+	if img.UUID != id || !CurrentUser(r).CanView(&img) { // image not returned
+		panic(httpErrorf(404, "image not found"))
 	}
 
 	imgcfg, imgfmt, err := image.DecodeConfig(bytes.NewReader(img.Data))
 	if err != nil {
-		if err != nil {
-			imageUpdateCh <- Status{
-				UUID:     uid,
-				Step:     "Failed to Decode Image (header): " + err.Error(),
-				Progress: -1,
-				Done:     true,
-			}
-
-			return
-		}
+		panic(httpErrorf(415, "Failed to Decode Image (header): %s", err))
 	}
 
 	job.UnprocessedImage = img
 
-	select {
-	case printQ <- job:
-		break
+	job.UUID = uuid.New()
+	newImageCh <- StatusNew{job.UUID, owner}
 
-	default:
+	err = pr.Enqueue(job)
+	if err != nil {
 		imageUpdateCh <- Status{
-			UUID: uid,
+			UUID: job.UUID,
 
-			Step:     "print queue full",
+			Step:     "Failed to queue job: " + err.Error(),
 			Progress: -1,
 			Done:     true,
 		}
+
+		panic(httpErrorf(queueErrorCode(err), "Failed to queue job: %s", err))
 	}
+
 	log.Printf("[POST] reprinting %s image with bounds: %d x %d", imgfmt, imgcfg.Width, imgcfg.Height)
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(200)
+
+	fmt.Fprintf(w, `<head>
+	  <meta http-equiv="Refresh" content="0; URL=/job/%s" />
+	</head>`, job.UUID)
 }
 
 func handlePrintList(w http.ResponseWriter, r *http.Request) {
@@ -337,20 +303,22 @@ func handlePrintList(w http.ResponseWriter, r *http.Request) {
 	} else {
 		offset, err = strconv.ParseUint(offsetstr[0], 10, 31)
 		if err != nil {
-			panic(err)
+			panic(httpErrorf(400, "Invalid offset: %s", err))
 		}
 
 		limit, err = strconv.ParseUint(limitstr[0], 10, 31)
 		if err != nil {
-			panic(err)
+			panic(httpErrorf(400, "Invalid limit: %s", err))
 		}
 
 		if limit > 100 {
-			panic("Invalid limit; limit > 100")
+			panic(httpErrorf(400, "Invalid limit; limit > 100"))
 		}
 	}
+	db = visibleImages(db, CurrentUser(r))
+
 	var length int
-	db.Select("count(1)").Where("is_processed", false).Where("is_processed", false).Find(&length)
+	db.Select("count(1)").Where("is_processed", false).Find(&length)
 
 	var l = &ImageList{
 		Offset: int(offset),
@@ -358,7 +326,7 @@ func handlePrintList(w http.ResponseWriter, r *http.Request) {
 		Total:  length,
 	}
 	db.Select("UUID", "UnProcessed", "Processed",
-		"IsProcessed", "Ext", "Public", "Name").Where("public", true).Where("is_processed", false).
+		"IsProcessed", "Ext", "Public", "Name", "Owner").Where("is_processed", false).
 		Order(clause.OrderByColumn{Column: clause.Column{Name: "created"}, Desc: true}).
 		Offset(int(offset)).Limit(int(limit)).Find(&l.Images)
 
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// LimitPrints rate limits print requests and rejects jobs exceeding the
+// per job maximum or a quota before anything is uploaded or queued
+func LimitPrints(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := GetConfig()
+		u, t := CurrentUser(r), apiToken(CurrentToken(r))
+
+		if conf.RateLimit > 0 {
+			ok, wait := printLimit.Allow(rateKey(r, u, t), conf.RateLimit, orDefault(conf.RateBurst, conf.RateLimit))
+			if !ok {
+				secs := int(math.Ceil(wait.Seconds()))
+
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				deny(w, r, http.StatusTooManyRequests,
+					fmt.Sprintf("rate limit of %d prints per minute exceeded, retry in %ds", conf.RateLimit, secs))
+				return
+			}
+		}
+
+		// the body of other requests is the image or template data
+		pfs := r.URL.Query().Get("pf")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			pfs = r.FormValue("pf")
+		}
+
+		pf := uint64(1)
+		if pfs != "" {
+			var err error
+			pf, err = strconv.ParseUint(pfs, 10, 32)
+			if err != nil { // reported by the handler
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		err := checkQuota(u, t, uint(pf))
+		switch err.(type) {
+		case nil:
+			next.ServeHTTP(w, r)
+
+		case *JobTooLargeError:
+			deny(w, r, http.StatusBadRequest, err.Error())
+
+		case *QuotaError:
+			log.Printf("[quota] %s: %s", u.Name, err)
+			deny(w, r, http.StatusForbidden, err.Error())
+
+		default:
+			panic(err)
+		}
+	})
+}
+
+// queueErrorCode returns the status code for an error of Enqueue
+func queueErrorCode(err error) int {
+	switch err.(type) {
+	case *JobTooLargeError:
+		return http.StatusBadRequest
+
+	case *QuotaError:
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+func rateKey(r *http.Request, u *User, t *Token) string {
+	switch {
+	case t != nil:
+		return "token:" + strconv.FormatUint(uint64(t.ID), 10)
+
+	case u != anonymous:
+		return "user:" + strconv.FormatUint(uint64(u.ID), 10)
+	}
+
+	return "addr:" + remoteHost(r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// apiToken returns t unless it is a login session, those share the quota
+// of the user
+func apiToken(t *Token) *Token {
+	if t == nil || t.Session {
+		return nil
+	}
+
+	return t
+}
+
+// tokenID returns the api token jobs of r are counted on, 0 if none
+func tokenID(r *http.Request) uint {
+	if t := apiToken(CurrentToken(r)); t != nil {
+		return t.ID
+	}
+
+	return 0
+}
+
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(UserQuota(CurrentUser(r)))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// handleUserQuota sets the quotas of a user, 0 is the default from the
+// config and -1 unlimited
+func handleUserQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	u := GetUser(mux.Vars(r)["name"])
+	if u == nil {
+		panic(httpErrorf(404, "unknown user %s", mux.Vars(r)["name"]))
+	}
+
+	var err error
+	u.DailyQuota, err = strconv.Atoi(r.FormValue("day"))
+	if err != nil {
+		panic(httpErrorf(400, "Invalid daily quota: %s", err))
+	}
+
+	u.MonthlyQuota, err = strconv.Atoi(r.FormValue("month"))
+	if err != nil {
+		panic(httpErrorf(400, "Invalid monthly quota: %s", err))
+	}
+
+	err = GetDB().Model(u).Select("daily_quota", "monthly_quota").Updates(u).Error
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("[POST] %s set quota of %s to %d/day %d/month", CurrentUser(r).Name, u.Name, u.DailyQuota, u.MonthlyQuota)
+
+	err = json.NewEncoder(w).Encode(UserQuota(u))
+	if err != nil {
+		panic(err)
+	}
+}
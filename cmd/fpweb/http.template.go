@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rileys-trash-can/libfp/fptemplate"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetTemplate loads the template name from the template directory; it is
+// read on every use so edits apply without restarting
+func GetTemplate(name string) (*fptemplate.Template, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, errTemplateName
+	}
+
+	return fptemplate.Load(filepath.Join(GetConfig().Templates, name+".yml"))
+}
+
+// ParseTemplate parses the source of template name, images are loaded from
+// the template directory
+func ParseTemplate(name string, src []byte) (t *fptemplate.Template, err error) {
+	t, err = fptemplate.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	t.FS = os.DirFS(GetConfig().Templates)
+	t.Name = T(t.Name != "", t.Name, name)
+
+	return
+}
+
+var errTemplateName = errors.New("invalid template name")
+
+// templateError is the http error for a failed GetTemplate
+func templateError(name string, err error) *HTTPError {
+	switch {
+	case errors.Is(err, errTemplateName):
+		return httpErrorf(400, "%s", err)
+
+	case errors.Is(err, fs.ErrNotExist):
+		return httpErrorf(404, "unknown template %s", name)
+	}
+
+	return httpErrorf(500, "%s", err)
+}
+
+// TemplateRequest is the body of POST /api/v1/templates/{name}/jobs
+type TemplateRequest struct {
+	Data json.RawMessage `json:"data"` // executed with the template
+
+	Printer  string `json:"printer,omitempty"`
+	PFCount  *uint  `json:"pf,omitempty"` // default 1
+	Priority int    `json:"priority,omitempty"`
+	Name     string `json:"name,omitempty"` // of the preview image
+	Public   bool   `json:"public,omitempty"`
+}
+
+func handleTemplatePrint(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+
+	q := r.URL.Query()
+	req := &TemplateRequest{
+		Data: raw,
+
+		Printer: first(q["printer"], ""),
+		Name:    first(q["name"], ""),
+		Public:  len(q["public"]) > 0,
+	}
+
+	if len(q["pf"]) > 0 {
+		pf, err := strconv.ParseUint(q["pf"][0], 10, 32)
+		if err != nil {
+			panic(httpErrorf(400, "Invalid PF Count: %s", err))
+		}
+
+		req.PFCount = new(uint)
+		*req.PFCount = uint(pf)
+	}
+
+	if len(q["priority"]) > 0 {
+		req.Priority, err = strconv.Atoi(q["priority"][0])
+		if err != nil {
+			panic(httpErrorf(400, "Invalid Priority: %s", err))
+		}
+	}
+
+	uid := queueTemplate(r, mux.Vars(r)["name"], req)
+
+	err = json.NewEncoder(w).Encode(&PrintJobID{uid})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// queueTemplate executes template name with req.Data and queues the label,
+// invalid requests panic with an HTTPError
+func queueTemplate(r *http.Request, name string, req *TemplateRequest) uuid.UUID {
+	t, err := GetTemplate(name)
+	if err != nil {
+		panic(templateError(name, err))
+	}
+
+	var data any
+	err = json.Unmarshal(req.Data, &data)
+	if err != nil {
+		panic(httpErrorf(400, "Invalid JSON data: %s", err))
+	}
+
+	var pf uint = 1
+	if req.PFCount != nil {
+		pf = *req.PFCount
+	}
+
+	pr := GetPrinter(req.Printer)
+	if pr == nil {
+		panic(httpErrorf(400, "unknown printer %s", req.Printer))
+	}
+
+	label, err := t.Execute(data)
+	if err != nil {
+		panic(httpErrorf(400, "%s", err))
+	}
+
+	// templates are laid out in dots, they only fit printers of their resolution
+	if dpi := pr.Resolution(); dpi > 0 && label.DPI > 0 && dpi != label.DPI {
+		panic(httpErrorf(409, "template %s is made for %d dpi, printer %s has %d dpi", name, label.DPI, pr.Name, dpi))
+	}
+
+	err = pr.checkLabelSize(label.Size)
+	if err != nil {
+		panic(httpErrorf(400, "template %s: %s", name, err))
+	}
+
+	log.Printf("[POST] printing template %s on %s", name, pr.Name)
+
+	uid := uuid.New()
+	owner := CurrentUser(r).ID
+	newImageCh <- StatusNew{uid, owner}
+
+	job := &PrintJob{
+		UUID:  uid,
+		owner: owner,
+		token: tokenID(r),
+
+		PFCount:   pf,
+		LabelSize: label.Size,
+		Priority:  req.Priority,
+		label:     label,
+		template:  name,
+		data:      req.Data,
+
+		// the template file may change while the job is queued
+		templateYML: t.Source,
+
+		public: req.Public,
+	}
+
+	// the preview is shown on the job page and listed like any other image
+	buf := &bytes.Buffer{}
+	err = encodeImage(buf, label.Render(), "png")
+	if err != nil {
+		panic(err)
+	}
+
+	job.UnprocessedImage = Image{
+		UUID: uuid.New(),
+
+		Owner:   owner,
+		Ext:     "png",
+		Data:    buf.Bytes(),
+		Public:  job.public,
+		Name:    T(req.Name != "", req.Name, name+" "+time.Now().Format(time.RFC3339)),
+		Created: time.Now(),
+	}
+
+	GetDB().Create(&job.UnprocessedImage)
+
+	imageUpdateCh <- Status{
+		UUID:         uid,
+		Step:         "queued",
+		CurrentImage: job.UnprocessedImage.UUID,
+	}
+
+	err = pr.Enqueue(job)
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:         uid,
+			Step:         "Failed to queue job: " + err.Error(),
+			CurrentImage: job.UnprocessedImage.UUID,
+			Progress:     -1,
+			Done:         true,
+		}
+
+		panic(httpErrorf(queueErrorCode(err), "Failed to queue job: %s", err))
+	}
+
+	return uid
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"net/http"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/rileys-trash-can/libfp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"strconv"
+	"time"
+)
+
+// api v1 takes and returns json, it is described by html/openapi.yaml;
+// failed validation is answered with 4xx and {"error": "..."} before
+// anything is queued
+
+// routeV1 adds the /api/v1 routes to gmux
+func routeV1(gmux *mux.Router) {
+	v1 := gmux.PathPrefix("/api/v1").Subrouter()
+
+	route := func(method, path string, level AuthLevel, h http.HandlerFunc) {
+		v1.Path(path).
+			Methods(method).
+			Handler(ErrorHandlerMiddleware(RequireAuth(level, jsonHandler(h))))
+	}
+
+	v1.Path("/openapi.yaml").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(&handleFile{"html/openapi.yaml", embedFS}))
+
+	// jobs
+	v1.Path("/jobs").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(jsonHandler(handlePrintV1)))))
+
+	v1.Path("/templates/{name}/jobs").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(jsonHandler(handleTemplatePrintV1)))))
+
+	route("GET", "/jobs/{uuid}", AuthUser, handleJobAPI)
+	route("GET", "/jobs/{uuid}/events", AuthUser, handleJobEvents)
+	route("DELETE", "/jobs/{uuid}", AuthUser, handleJobCancelV1)
+	route("PATCH", "/jobs/{uuid}", AuthUser, handleJobPatchV1)
+
+	route("GET", "/queue", AuthUser, handleQueue)
+	route("PUT", "/queue", AuthAdmin, handleQueuePutV1)
+
+	// images
+	route("GET", "/images", AuthAny, handleImagesV1)
+	route("GET", "/images/{uuid}", AuthAny, handleImageV1)
+	route("GET", "/images/{uuid}/data", AuthAny, handleImageDataV1)
+
+	// printers
+	route("GET", "/printers", AuthUser, handlePrinters)
+	route("GET", "/printers/{name}", AuthUser, handlePrinterV1)
+
+	// users
+	route("GET", "/me", AuthUser, handleMe)
+	route("GET", "/me/quota", AuthUser, handleQuota)
+	route("GET", "/tokens", AuthUser, handleTokens)
+	route("POST", "/tokens", AuthUser, handleTokenCreateV1)
+	route("DELETE", "/tokens/{id}", AuthUser, handleTokenDelete)
+
+	route("GET", "/users", AuthAdmin, handleUsers)
+	route("POST", "/users", AuthAdmin, handleUserCreateV1)
+	route("DELETE", "/users/{name}", AuthAdmin, handleUserDelete)
+	route("PUT", "/users/{name}/quota", AuthAdmin, handleUserQuotaV1)
+}
+
+// errors before the handler sets a content type are answered in json too
+func jsonHandler(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		next(w, r)
+	})
+}
+
+// decodeJSON reads the body of r into v, unknown fields are an error
+func decodeJSON(r *http.Request, v any) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(v)
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "Invalid JSON body: %s", err))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+func parseUUID(r *http.Request, what string) uuid.UUID {
+	id, err := uuid.Parse(mux.Vars(r)["uuid"])
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "Invalid %s id: %s", what, err))
+	}
+
+	return id
+}
+
+// ownStatus returns the status of job id if the user of r may see it
+func ownStatus(r *http.Request, id uuid.UUID) *Status {
+	status := GetStatus(id)
+	if status == nil || !CurrentUser(r).Owns(status.Owner) {
+		panic(httpErrorf(http.StatusNotFound, "job not found"))
+	}
+
+	return status
+}
+
+// PrintRequest is the body of POST /api/v1/jobs; the image is base64 in
+// json or the "image" part of a multipart/form-data request whose
+// "request" part is this json
+type PrintRequest struct {
+	Image   []byte     `json:"image,omitempty"`
+	ImageID *uuid.UUID `json:"image_id,omitempty"` // reprints a stored image instead
+
+	Printer  string `json:"printer,omitempty"`
+	PFCount  *uint  `json:"pf,omitempty"`     // default 1
+	Width    int    `json:"width,omitempty"`  // label size in dots, defaults to the printers
+	Height   int    `json:"height,omitempty"` //
+	Dither   string `json:"dither,omitempty"`
+	Filters  string `json:"filters,omitempty"` // see fp.ParseFilters
+	Priority int    `json:"priority,omitempty"`
+	Name     string `json:"name,omitempty"`
+
+	Public  bool `json:"public,omitempty"`
+	Resize  bool `json:"resize,omitempty"`
+	Stretch bool `json:"stretch,omitempty"`
+	Rotate  bool `json:"rotate,omitempty"`
+	CenterH bool `json:"centerh,omitempty"`
+	CenterV bool `json:"centerv,omitempty"`
+	Tiling  bool `json:"tiling,omitempty"`
+}
+
+func readPrintRequest(r *http.Request) (req *PrintRequest) {
+	req = new(PrintRequest)
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		decodeJSON(r, req)
+
+	case "multipart/form-data":
+		if j := r.FormValue("request"); j != "" {
+			dec := json.NewDecoder(bytes.NewReader([]byte(j)))
+			dec.DisallowUnknownFields()
+
+			err := dec.Decode(req)
+			if err != nil {
+				panic(httpErrorf(http.StatusBadRequest, "Invalid JSON request: %s", err))
+			}
+		}
+
+		f, header, err := r.FormFile("image")
+		if err != nil && !errors.Is(err, http.ErrMissingFile) {
+			panic(httpErrorf(http.StatusBadRequest, "Invalid image upload: %s", err))
+		}
+
+		if err == nil {
+			defer f.Close()
+
+			req.Image, err = io.ReadAll(f)
+			if err != nil {
+				panic(httpErrorf(http.StatusBadRequest, "Invalid image upload: %s", err))
+			}
+
+			if req.Name == "" {
+				req.Name = header.Filename
+			}
+		}
+
+	default:
+		panic(httpErrorf(http.StatusUnsupportedMediaType, "Content-Type must be application/json or multipart/form-data"))
+	}
+
+	return
+}
+
+func handlePrintV1(w http.ResponseWriter, r *http.Request) {
+	req := readPrintRequest(r)
+	u := CurrentUser(r)
+
+	pr := GetPrinter(req.Printer)
+	if pr == nil {
+		panic(httpErrorf(http.StatusBadRequest, "unknown printer %s", req.Printer))
+	}
+
+	var pf uint = 1
+	if req.PFCount != nil {
+		pf = *req.PFCount
+	}
+
+	_, err := fp.DitherFromString(req.Dither)
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "%s", err))
+	}
+
+	_, err = fp.ParseFilters(req.Filters)
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "%s", err))
+	}
+
+	size := image.Pt(req.Width, req.Height)
+	if size.X == 0 && size.Y == 0 {
+		size, _ = pr.LabelSize()
+	}
+
+	if size.X <= 0 || size.Y <= 0 {
+		panic(httpErrorf(http.StatusBadRequest, "no label size specified and printer %s has none", pr.Name))
+	}
+
+	err = pr.checkLabelSize(size)
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "%s", err))
+	}
+
+	var img Image
+	switch {
+	case len(req.Image) > 0 && req.ImageID != nil:
+		panic(httpErrorf(http.StatusBadRequest, "image and image_id are exclusive"))
+
+	case req.ImageID != nil:
+		img = GetImage(*req.ImageID)
+		if img.UUID != *req.ImageID || !u.CanView(&img) {
+			panic(httpErrorf(http.StatusBadRequest, "image %s not found", *req.ImageID))
+		}
+
+	case len(req.Image) > 0:
+		_, format, err := image.DecodeConfig(bytes.NewReader(req.Image))
+		if err != nil {
+			panic(httpErrorf(http.StatusUnsupportedMediaType, "Failed to decode image: %s", err))
+		}
+
+		img = Image{
+			UUID: uuid.New(),
+
+			Owner:   u.ID,
+			Ext:     format,
+			Data:    req.Image,
+			Public:  req.Public,
+			Name:    T(req.Name != "", req.Name, time.Now().Format(time.RFC3339)),
+			Created: time.Now(),
+		}
+
+	default:
+		panic(httpErrorf(http.StatusBadRequest, "no image or image_id specified"))
+	}
+
+	// checked again when queueing, this one fails before storing anything
+	err = checkQuota(u, apiToken(CurrentToken(r)), pf)
+	if err != nil {
+		panic(httpErrorf(queueErrorCode(err), "%s", err))
+	}
+
+	if req.ImageID == nil {
+		GetDB().Create(&img)
+	}
+
+	uid := uuid.New()
+	newImageCh <- StatusNew{uid, u.ID}
+
+	job := &PrintJob{
+		UUID:  uid,
+		owner: u.ID,
+		token: tokenID(r),
+
+		UnprocessedImage: img,
+
+		PFCount:   pf,
+		LabelSize: size,
+		Priority:  req.Priority,
+		dither:    req.Dither,
+		filters:   req.Filters,
+
+		public:     req.Public,
+		optresize:  req.Resize,
+		optstretch: req.Stretch,
+		optrotate:  req.Rotate,
+		optcenterh: req.CenterH,
+		optcenterv: req.CenterV,
+		opttiling:  req.Tiling,
+	}
+
+	err = pr.Enqueue(job)
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:     uid,
+			Step:     "Failed to queue job: " + err.Error(),
+			Progress: -1,
+			Done:     true,
+		}
+
+		panic(httpErrorf(queueErrorCode(err), "Failed to queue job: %s", err))
+	}
+
+	log.Printf("[POST] /api/v1/jobs: %s on %s", uid, pr.Name)
+
+	w.Header().Set("Location", "/api/v1/jobs/"+uid.String())
+	writeJSON(w, http.StatusAccepted, GetStatus(uid))
+}
+
+func handleTemplatePrintV1(w http.ResponseWriter, r *http.Request) {
+	req := new(TemplateRequest)
+	decodeJSON(r, req)
+
+	if len(req.Data) == 0 {
+		panic(httpErrorf(http.StatusBadRequest, "no template data specified"))
+	}
+
+	uid := queueTemplate(r, mux.Vars(r)["name"], req)
+
+	w.Header().Set("Location", "/api/v1/jobs/"+uid.String())
+	writeJSON(w, http.StatusAccepted, GetStatus(uid))
+}
+
+func handleJobCancelV1(w http.ResponseWriter, r *http.Request) {
+	uid := parseUUID(r, "job")
+	ownStatus(r, uid)
+
+	err := CancelJob(uid)
+	if err != nil {
+		panic(httpErrorf(http.StatusConflict, "%s", err))
+	}
+
+	log.Printf("[DELETE] cancelled job %s", uid)
+
+	writeJSON(w, http.StatusOK, GetStatus(uid))
+}
+
+// JobPatch is the body of PATCH /api/v1/jobs/{uuid}
+type JobPatch struct {
+	Priority *int `json:"priority"`
+}
+
+func handleJobPatchV1(w http.ResponseWriter, r *http.Request) {
+	uid := parseUUID(r, "job")
+	ownStatus(r, uid)
+
+	var patch JobPatch
+	decodeJSON(r, &patch)
+
+	if patch.Priority != nil {
+		err := SetJobPriority(CurrentUser(r), uid, *patch.Priority)
+		if err != nil {
+			panic(httpErrorf(http.StatusConflict, "%s", err))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, GetStatus(uid))
+}
+
+// QueuePut is the body of PUT /api/v1/queue
+type QueuePut struct {
+	Paused bool `json:"paused"`
+}
+
+func handleQueuePutV1(w http.ResponseWriter, r *http.Request) {
+	var q QueuePut
+	decodeJSON(r, &q)
+
+	PauseQueue(q.Paused)
+	log.Printf("[PUT] queue paused: %t", q.Paused)
+
+	handleQueue(w, r)
+}
+
+// ImageInfo describes a stored image without its data
+type ImageInfo struct {
+	ID          uuid.UUID  `json:"id"`
+	Name        string     `json:"name"`
+	Ext         string     `json:"ext"`
+	Public      bool       `json:"public"`
+	Owner       uint       `json:"owner"`
+	IsProcessed bool       `json:"is_processed"`
+	UnProcessed *uuid.UUID `json:"unprocessed,omitempty"` // of processed images
+	Processed   *uuid.UUID `json:"processed,omitempty"`   // of unprocessed images
+	Created     time.Time  `json:"created"`
+}
+
+func (i *Image) Info() ImageInfo {
+	return ImageInfo{
+		ID:          i.UUID,
+		Name:        i.Name,
+		Ext:         i.Ext,
+		Public:      i.Public,
+		Owner:       i.Owner,
+		IsProcessed: i.IsProcessed,
+		UnProcessed: i.UnProcessed,
+		Processed:   i.Processed,
+		Created:     i.Created,
+	}
+}
+
+type ImagePage struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Total  int `json:"total"`
+
+	Images []ImageInfo `json:"images"`
+}
+
+func queryInt(r *http.Request, name string, def, max int) int {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 || (max > 0 && i > max) {
+		panic(httpErrorf(http.StatusBadRequest, "Invalid %s: %s", name, v))
+	}
+
+	return i
+}
+
+func handleImagesV1(w http.ResponseWriter, r *http.Request) {
+	page := &ImagePage{
+		Offset: queryInt(r, "offset", 0, 0),
+		Limit:  queryInt(r, "limit", 20, 100),
+	}
+
+	db := visibleImages(GetDB().Model(&Image{}), CurrentUser(r))
+	if p := r.URL.Query().Get("processed"); p != "" {
+		db = db.Where("is_processed = ?", BoolFromString(p)).Session(&gorm.Session{})
+	}
+
+	var total int64
+	db.Count(&total)
+	page.Total = int(total)
+
+	var images []Image
+	err := db.Omit("data").
+		Order(clause.OrderByColumn{Column: clause.Column{Name: "created"}, Desc: true}).
+		Offset(page.Offset).Limit(page.Limit).Find(&images).Error
+	if err != nil {
+		panic(err)
+	}
+
+	page.Images = make([]ImageInfo, len(images))
+	for i := range images {
+		page.Images[i] = images[i].Info()
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func visibleImage(r *http.Request) *Image {
+	id := parseUUID(r, "image")
+
+	img := GetImage(id)
+	if img.UUID != id || !CurrentUser(r).CanView(&img) {
+		panic(httpErrorf(http.StatusNotFound, "image not found"))
+	}
+
+	return &img
+}
+
+func handleImageV1(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, visibleImage(r).Info())
+}
+
+func handleImageDataV1(w http.ResponseWriter, r *http.Request) {
+	img := visibleImage(r)
+
+	ct := mime.TypeByExtension("." + img.Ext)
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", ct)
+	w.Write(img.Data)
+}
+
+func handlePrinterV1(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	pr := GetPrinter(name)
+	if pr == nil || name == "" {
+		panic(httpErrorf(http.StatusNotFound, "unknown printer %s", name))
+	}
+
+	writeJSON(w, http.StatusOK, pr.Info())
+}
+
+// TokenRequest is the body of POST /api/v1/tokens
+type TokenRequest struct {
+	Name  string `json:"name"`
+	Day   uint   `json:"day,omitempty"`   // labels per day, 0 is unlimited
+	Month uint   `json:"month,omitempty"` // labels per month, 0 is unlimited
+}
+
+func handleTokenCreateV1(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	decodeJSON(r, &req)
+
+	u := CurrentUser(r)
+	if u == anonymous {
+		panic(httpErrorf(http.StatusBadRequest, "authentication is disabled"))
+	}
+
+	if req.Name == "" {
+		panic(httpErrorf(http.StatusBadRequest, "no token name specified"))
+	}
+
+	secret, t, err := NewToken(u, req.Name, false, req.Day, req.Month)
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("[POST] %s created token '%s'", u.Name, req.Name)
+
+	writeJSON(w, http.StatusCreated, &NewTokenRes{Token: secret, Detail: t})
+}
+
+// UserRequest is the body of POST /api/v1/users
+type UserRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin,omitempty"`
+}
+
+func handleUserCreateV1(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	decodeJSON(r, &req)
+
+	if GetUser(req.Name) != nil {
+		panic(httpErrorf(http.StatusConflict, "user %s exists", req.Name))
+	}
+
+	u, err := CreateUser(req.Name, req.Password, req.Admin)
+	if err != nil {
+		panic(httpErrorf(http.StatusBadRequest, "%s", err))
+	}
+
+	log.Printf("[POST] %s created user %s (admin: %t)", CurrentUser(r).Name, u.Name, u.Admin)
+
+	writeJSON(w, http.StatusCreated, u)
+}
+
+// QuotaRequest is the body of PUT /api/v1/users/{name}/quota, 0 is the
+// default from the config and -1 unlimited
+type QuotaRequest struct {
+	Day   int `json:"day"`
+	Month int `json:"month"`
+}
+
+func handleUserQuotaV1(w http.ResponseWriter, r *http.Request) {
+	var req QuotaRequest
+	decodeJSON(r, &req)
+
+	u := GetUser(mux.Vars(r)["name"])
+	if u == nil {
+		panic(httpErrorf(http.StatusNotFound, "unknown user %s", mux.Vars(r)["name"]))
+	}
+
+	u.DailyQuota, u.MonthlyQuota = req.Day, req.Month
+
+	err := GetDB().Model(u).Select("daily_quota", "monthly_quota").Updates(u).Error
+	if err != nil {
+		panic(err)
+	}
+
+	log.Printf("[PUT] %s set quota of %s to %d/day %d/month", CurrentUser(r).Name, u.Name, u.DailyQuota, u.MonthlyQuota)
+
+	writeJSON(w, http.StatusOK, UserQuota(u))
+}
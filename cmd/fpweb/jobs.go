@@ -0,0 +1,496 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/rileys-trash-can/libfp"
+	"github.com/rileys-trash-can/libfp/fptemplate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JobQueued   = "queued"
+	JobPrinting = "printing"
+	JobFinished = "finished"
+)
+
+// Job is the persisted form of a PrintJob and its latest Status; rows are
+// kept as history after the job finished
+type Job struct {
+	UUID    uuid.UUID `gorm:"primaryKey"`
+	Created time.Time `gorm:"index"`
+	Updated time.Time
+
+	Owner   uint   `gorm:"index"` // User.ID
+	Token   uint   // Token.ID the labels are counted on, 0 if none
+	Charged string // Usage.Day the labels are counted on, empty if not charged
+
+	// set by Enqueue
+	Printer  string `gorm:"index"`
+	State    string `gorm:"index"` // JobQueued, JobPrinting or JobFinished; empty if never queued
+	Priority int    // higher is printed first
+
+	Image        uuid.UUID // unprocessed image
+	PFCount      uint
+	Printed      uint // labels fed, an interrupted job continues after them
+	Width        int
+	Height       int
+	Dither       string
+	Filters      string
+	Template     string // label jobs are executed from Template and TemplateData
+	TemplateData []byte
+	TemplateYML  []byte // Template as it was when queued
+
+	Public  bool
+	Resize  bool
+	Stretch bool
+	Rotate  bool
+	CenterH bool
+	CenterV bool
+	Tiling  bool
+
+	// set by doStatus
+	Step         string
+	CurrentImage uuid.UUID
+	Preview      uuid.UUID
+	Done         bool
+	Progress     float32
+}
+
+// the status and the job half of a row are written independently, whichever
+// comes first creates it
+var (
+	jobColumns = []string{"owner", "token", "charged", "printer", "state", "priority", "image", "pf_count", "width", "height",
+		"dither", "filters", "template", "template_data", "template_yml",
+		"public", "resize", "stretch", "rotate", "center_h", "center_v", "tiling"}
+
+	statusColumns = []string{"updated", "step", "current_image", "done", "progress"}
+)
+
+func upsertJob(j *Job, columns []string) error {
+	return GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "uuid"}},
+		DoUpdates: clause.AssignmentColumns(columns),
+	}).Create(j).Error
+}
+
+func (j *Job) Status() *Status {
+	return &Status{
+		UUID:         j.UUID,
+		Step:         j.Step,
+		CurrentImage: j.CurrentImage,
+		Preview:      j.Preview,
+		Done:         j.Done,
+		Progress:     j.Progress,
+
+		Printer:  j.Printer,
+		State:    j.State,
+		Priority: j.Priority,
+		Owner:    j.Owner,
+	}
+}
+
+// saveStatus stores s in the job row of s.UUID
+func saveStatus(s *Status) {
+	now := time.Now()
+
+	columns := statusColumns
+	if s.Preview != uuid.Nil { // the preview is only sent once
+		columns = append(columns[:len(columns):len(columns)], "preview")
+	}
+
+	if s.Owner != 0 { // only set on creation
+		columns = append(columns[:len(columns):len(columns)], "owner")
+	}
+
+	err := upsertJob(&Job{
+		UUID:    s.UUID,
+		Created: now,
+		Updated: now,
+
+		Owner: s.Owner,
+
+		Step:         s.Step,
+		CurrentImage: s.CurrentImage,
+		Preview:      s.Preview,
+		Done:         s.Done,
+		Progress:     s.Progress,
+	}, columns)
+	if err != nil {
+		log.Printf("[jobs] Failed to save status of %s: %s", s.UUID, err)
+	}
+}
+
+// loadStatus returns the status of job id, nil if unknown
+func loadStatus(id uuid.UUID) *Status {
+	var j Job
+	res := GetDB().Where("uuid = ?", id).Limit(1).Find(&j)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil
+	}
+
+	return j.Status()
+}
+
+// Enqueue stores job to be printed by pr and wakes its worker, its labels
+// are counted on the quota of its owner
+func (pr *Printer) Enqueue(job *PrintJob) error {
+	u, err := jobOwner(job)
+	if err != nil {
+		return err
+	}
+
+	job.Priority = userPriority(u, job.Priority)
+
+	err = chargeQuota(job)
+	if err != nil {
+		return err
+	}
+
+	err = upsertJob(&Job{
+		UUID:    job.UUID,
+		Created: time.Now(),
+		Owner:   job.owner,
+		Token:   job.token,
+		Charged: job.charged,
+
+		Printer:  pr.Name,
+		State:    JobQueued,
+		Priority: job.Priority,
+
+		Image:        job.UnprocessedImage.UUID,
+		PFCount:      job.PFCount,
+		Width:        job.LabelSize.X,
+		Height:       job.LabelSize.Y,
+		Dither:       job.dither,
+		Filters:      job.filters,
+		Template:     job.template,
+		TemplateData: job.data,
+		TemplateYML:  job.templateYML,
+
+		Public:  job.public,
+		Resize:  job.optresize,
+		Stretch: job.optstretch,
+		Rotate:  job.optrotate,
+		CenterH: job.optcenterh,
+		CenterV: job.optcenterv,
+		Tiling:  job.opttiling,
+	}, jobColumns)
+	if err != nil {
+		refundQuota(job, job.PFCount)
+		return err
+	}
+
+	pr.wake()
+	return nil
+}
+
+func (pr *Printer) wake() {
+	select {
+	case pr.queue <- struct{}{}:
+	default:
+	}
+}
+
+// Queued returns the number of jobs waiting for pr
+func (pr *Printer) Queued() (n int64) {
+	GetDB().Model(&Job{}).Where("printer = ? AND state = ?", pr.Name, JobQueued).Count(&n)
+
+	return
+}
+
+// all workers stop taking jobs while set, running ones are finished
+var queuePaused atomic.Bool
+
+// PauseQueue pauses or resumes all printers
+func PauseQueue(pause bool) {
+	queuePaused.Store(pause)
+
+	if !pause {
+		for _, pr := range printers {
+			pr.wake()
+		}
+	}
+}
+
+// nextJob blocks until a job is queued for pr and marks it as printing and
+// running, ctx is cancelled by CancelJob; jobs that fail to load are
+// finished with an error status
+func nextJob(pr *Printer) (job *PrintJob, ctx context.Context, cancel context.CancelFunc) {
+	// jobs queued by another instance sharing the db are picked up late
+	t := time.NewTicker(time.Second * 10)
+	defer t.Stop()
+
+	for {
+		var j Job
+		var res *gorm.DB
+		if !queuePaused.Load() {
+			res = GetDB().Where("printer = ? AND state = ?", pr.Name, JobQueued).
+				Order("priority desc, created").Limit(1).Find(&j)
+			if res.Error != nil {
+				log.Printf("[printQ] Failed to read queue of %s: %s", pr.Name, res.Error)
+			}
+		}
+
+		if res == nil || res.Error != nil || res.RowsAffected == 0 {
+			select {
+			case <-pr.queue:
+			case <-t.C:
+			}
+
+			continue
+		}
+
+		// the job may have been cancelled in the meantime
+		ctx, cancel = context.WithCancel(context.Background())
+		if !pr.claim(j.UUID, cancel) {
+			cancel()
+			continue
+		}
+
+		var err error
+		job, err = loadJob(&j)
+		if err != nil {
+			pr.setRunning(uuid.Nil, nil)
+			cancel()
+			refundJob(&j)
+
+			imageUpdateCh <- Status{
+				UUID:     j.UUID,
+				Step:     "Failed to load job: " + err.Error(),
+				Progress: -1,
+				Done:     true,
+			}
+
+			finishJob(j.UUID)
+			continue
+		}
+
+		return
+	}
+}
+
+func loadJob(j *Job) (job *PrintJob, err error) {
+	job = &PrintJob{
+		UUID: j.UUID,
+
+		owner:     j.Owner,
+		token:     j.Token,
+		charged:   j.Charged,
+		PFCount:   j.PFCount,
+		printed:   j.Printed,
+		LabelSize: image.Pt(j.Width, j.Height),
+		dither:    j.Dither,
+		filters:   j.Filters,
+		template:  j.Template,
+		data:      j.TemplateData,
+
+		templateYML: j.TemplateYML,
+
+		public:     j.Public,
+		optresize:  j.Resize,
+		optstretch: j.Stretch,
+		optrotate:  j.Rotate,
+		optcenterh: j.CenterH,
+		optcenterv: j.CenterV,
+		opttiling:  j.Tiling,
+	}
+
+	// unknown names of old jobs are not dithered
+	job.ditherer, _ = fp.DitherFromString(j.Dither)
+
+	fs, err := fp.ParseFilters(j.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fs) > 0 {
+		job.filter = fs
+	}
+
+	job.UnprocessedImage = GetImage(j.Image)
+	if job.UnprocessedImage.UUID != j.Image {
+		return nil, fmt.Errorf("image %s not found", j.Image)
+	}
+
+	if j.Template == "" {
+		return
+	}
+
+	// jobs queued by older versions only have the name
+	var t *fptemplate.Template
+	if len(j.TemplateYML) > 0 {
+		t, err = ParseTemplate(j.Template, j.TemplateYML)
+	} else {
+		t, err = GetTemplate(j.Template)
+	}
+
+	if err != nil {
+		return
+	}
+
+	var data any
+	err = json.Unmarshal(j.TemplateData, &data)
+	if err != nil {
+		return
+	}
+
+	job.label, err = t.Execute(data)
+	return
+}
+
+// CancelJob removes a queued job or stops it between chunks or labels if
+// it is being printed
+func CancelJob(id uuid.UUID) error {
+	res := GetDB().Model(&Job{}).Where("uuid = ? AND state = ?", id, JobQueued).
+		Update("state", JobFinished)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected > 0 {
+		var j Job
+		err := GetDB().Where("uuid = ?", id).First(&j).Error
+		if err == nil {
+			refundJob(&j)
+		}
+
+		imageUpdateCh <- Status{
+			UUID:     id,
+			Step:     "cancelled",
+			Progress: -1,
+			Done:     true,
+		}
+
+		return nil
+	}
+
+	for _, pr := range printers {
+		if pr.cancelRunning(id) {
+			return nil
+		}
+	}
+
+	return errors.New("job is neither queued nor printing")
+}
+
+// refundJob refunds all labels of j, which was never printed
+func refundJob(j *Job) {
+	refundQuota(&PrintJob{UUID: j.UUID, owner: j.Owner, token: j.Token, charged: j.Charged}, j.PFCount)
+}
+
+// userPriority limits the priority u can give a job to priority.max, so
+// only admins can put jobs ahead of everyone else's
+func userPriority(u *User, priority int) int {
+	if u.Admin {
+		return priority
+	}
+
+	return min(priority, GetConfig().MaxPriority)
+}
+
+// SetJobPriority changes the priority of a queued job on behalf of u
+func SetJobPriority(u *User, id uuid.UUID, priority int) error {
+	res := GetDB().Model(&Job{}).Where("uuid = ? AND state = ?", id, JobQueued).
+		Update("priority", userPriority(u, priority))
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return errors.New("job is not queued")
+	}
+
+	return nil
+}
+
+type QueuedJob struct {
+	ID       uuid.UUID `json:"id"`
+	Printer  string    `json:"printer"`
+	State    string    `json:"state"`
+	Priority int       `json:"priority"`
+	PFCount  uint      `json:"pf"`
+	Step     string    `json:"message"`
+	Created  time.Time `json:"created"`
+}
+
+// Queue returns the jobs of u queued or printing in the order they are
+// printed, all of them for admins
+func Queue(u *User) (jobs []QueuedJob, err error) {
+	q := GetDB().Where("state IN ?", []string{JobQueued, JobPrinting})
+	if !u.Admin {
+		q = q.Where("owner = ?", u.ID)
+	}
+
+	var rows []Job
+	err = q.Order("state = 'printing' desc, priority desc, created").Find(&rows).Error
+	if err != nil {
+		return
+	}
+
+	jobs = make([]QueuedJob, len(rows))
+	for i, j := range rows {
+		jobs[i] = QueuedJob{
+			ID:       j.UUID,
+			Printer:  j.Printer,
+			State:    j.State,
+			Priority: j.Priority,
+			PFCount:  j.PFCount,
+			Step:     j.Step,
+			Created:  j.Created,
+		}
+	}
+
+	return
+}
+
+func finishJob(id uuid.UUID) {
+	GetDB().Model(&Job{}).Where("uuid = ?", id).Update("state", JobFinished)
+}
+
+// setPrinted remembers that n labels of job id were fed
+func setPrinted(id uuid.UUID, n uint) {
+	err := GetDB().Model(&Job{}).Where("uuid = ?", id).Update("printed", n).Error
+	if err != nil {
+		log.Printf("[jobs] Failed to store labels fed of %s: %s", id, err)
+	}
+}
+
+// resumeJobs queues jobs interrupted by a restart again, they continue
+// after the labels already fed; their quota was charged when queued
+func resumeJobs() {
+	err := GetDB().Model(&Job{}).Where("state = ? AND printed >= pf_count AND pf_count > 0", JobPrinting).
+		Update("state", JobFinished).Error
+	if err != nil {
+		log.Fatalf("Failed to resume jobs: %s", err)
+	}
+
+	res := GetDB().Model(&Job{}).Where("state = ?", JobPrinting).Update("state", JobQueued)
+	if res.Error != nil {
+		log.Fatalf("Failed to resume jobs: %s", res.Error)
+	}
+
+	if res.RowsAffected > 0 {
+		log.Printf("[jobs] %d interrupted jobs are printed again", res.RowsAffected)
+	}
+
+	var orphaned int64
+	q := GetDB().Model(&Job{}).Where("state = ?", JobQueued)
+	for _, pr := range printers {
+		q = q.Where("printer <> ?", pr.Name)
+	}
+
+	q.Count(&orphaned)
+	if orphaned > 0 {
+		log.Printf("[jobs] %d queued jobs are for printers no longer configured", orphaned)
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"bytes"
 	"encoding/base64"
 	"github.com/gorilla/mux"
-	"github.com/makeworld-the-better-one/dither/v2"
-	"github.com/rileys-trash-can/libfp"
 	"log"
 	"time"
 
@@ -16,13 +14,10 @@ import (
 	_ "github.com/samuel/go-pcx/pcx"
 	_ "golang.org/x/image/bmp"
 	"image"
-	"image/color"
 	_ "image/jpeg"
 	"image/png"
 )
 
-var printer *fp.Printer
-
 func main() {
 	log.SetFlags(log.Flags() | log.Lshortfile)
 	flag.Parse()
@@ -30,10 +25,9 @@ func main() {
 
 	// verify DB is valid
 	GetDB()
+	setupUsers()
 
-	if !*OptDryRun {
-		printer = OpenPrinter()
-	}
+	setupPrinters()
 
 	gmux := mux.NewRouter()
 
@@ -45,11 +39,11 @@ func main() {
 	// static stuff
 	gmux.Path("/").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(&handleFile{"html/index.html", embedFS}))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, &handleFile{"html/index.html", embedFS})))
 
 	gmux.Path("/list").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handlePrintList)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAny, http.HandlerFunc(handlePrintList))))
 
 	gmux.Path("/bs.css").
 		Methods("GET").
@@ -59,35 +53,127 @@ func main() {
 		Methods("GET").
 		Handler(ErrorHandlerMiddleware(&handleFile{"html/index.txt", embedFS}))
 
+	// user stuff
+	gmux.Path("/login").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(&handleFile{"html/login.html", embedFS}))
+
+	gmux.Path("/login").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleLogin)))
+
+	gmux.Path("/logout").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleLogout)))
+
+	gmux.Path("/api/me").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleMe))))
+
+	gmux.Path("/api/me/password").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handlePassword))))
+
+	gmux.Path("/api/me/quota").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleQuota))))
+
+	gmux.Path("/api/tokens").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleTokens))))
+
+	gmux.Path("/api/tokens").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleTokenCreate))))
+
+	gmux.Path("/api/tokens/{id}").
+		Methods("DELETE").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleTokenDelete))))
+
+	gmux.Path("/api/users").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, http.HandlerFunc(handleUsers))))
+
+	gmux.Path("/api/users").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, http.HandlerFunc(handleUserCreate))))
+
+	gmux.Path("/api/users/{name}/quota").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, http.HandlerFunc(handleUserQuota))))
+
+	gmux.Path("/api/users/{name}").
+		Methods("DELETE").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, http.HandlerFunc(handleUserDelete))))
+
 	// ui stuff
 	gmux.Path("/img/{uuid}").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleGetImg)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAny, http.HandlerFunc(handleGetImg))))
 
 	gmux.Path("/job/{uuid}").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleJob)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleJob))))
 
 	gmux.Path("/api/print").
 		Methods("POST").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handlePrintPOST)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(http.HandlerFunc(handlePrintPOST)))))
 
-	gmux.Path("/api/print").
-		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handlePrintGET)))
+	// not GET, links from other sites would print with the session cookie
+	gmux.Path("/api/reprint").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(http.HandlerFunc(handleReprint)))))
 
 	// api stuff
 	gmux.Path("/api/print").
 		Methods("PUT").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handlePrint)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(http.HandlerFunc(handlePrint)))))
+
+	gmux.Path("/api/job/{uuid}").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleJobAPI))))
 
 	gmux.Path("/api/job/{uuid}").
+		Methods("DELETE").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleJobCancel))))
+
+	gmux.Path("/api/job/{uuid}/events").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleJobEvents))))
+
+	gmux.Path("/api/job/{uuid}/priority").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleJobPriority))))
+
+	gmux.Path("/api/queue").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handleQueue))))
+
+	gmux.Path("/api/queue/pause").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, handleQueuePause(true))))
+
+	gmux.Path("/api/queue/resume").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAdmin, handleQueuePause(false))))
+
+	gmux.Path("/api/template/{name}").
+		Methods("POST").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, LimitPrints(http.HandlerFunc(handleTemplatePrint)))))
+
+	gmux.Path("/api/printer").
+		Methods("GET").
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handlePrinterInfo))))
+
+	gmux.Path("/api/printers").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleJobAPI)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthUser, http.HandlerFunc(handlePrinters))))
 
 	gmux.Path("/api/list").
 		Methods("GET").
-		Handler(ErrorHandlerMiddleware(http.HandlerFunc(handleList)))
+		Handler(ErrorHandlerMiddleware(RequireAuth(AuthAny, http.HandlerFunc(handleList))))
+
+	routeV1(gmux)
 
 	addr := T(*ListenAddr != "", *ListenAddr, conf.Listen)
 
@@ -107,42 +193,6 @@ func main() {
 		http.ListenAndServe(addr, gmux))
 }
 
-type Filter interface {
-	Apply(img image.Image) image.Image
-}
-
-type PixMapperFilter struct {
-	mapper *dither.Ditherer
-}
-
-func (mf *PixMapperFilter) Apply(src image.Image) image.Image {
-	return mf.mapper.Dither(src)
-}
-
-func DitherFromString(n string) Filter {
-	switch n {
-	case "o4x4": // to dither
-		mapper := dither.NewDitherer([]color.Color{color.White, color.Black})
-		mapper.Mapper = dither.PixelMapperFromMatrix(dither.ClusteredDot4x4, 1.0)
-
-		return &PixMapperFilter{mapper: mapper}
-
-	case "noise": // to dither
-		mapper := dither.NewDitherer([]color.Color{color.White, color.Black})
-		mapper.Mapper = dither.RandomNoiseGrayscale(.1, .5)
-
-		return &PixMapperFilter{mapper: mapper}
-
-	case "bayer": // to dither
-		mapper := dither.NewDitherer([]color.Color{color.White, color.Black})
-		mapper.Mapper = dither.Bayer(3, 3, .6)
-
-		return &PixMapperFilter{mapper: mapper}
-	}
-
-	return nil
-}
-
 func BoolFromString(n string) bool {
 	switch n {
 	case "on":
@@ -1,32 +1,44 @@
 package main
 
 import (
-	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/dither/v2"
 	"github.com/rileys-trash-can/libfp"
+	"github.com/rileys-trash-can/libfp/fptest"
 
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"image"
-	"image/color"
-	"image/draw"
 	"log"
 	"time"
 )
 
-var (
-	printQ = make(chan *PrintJob, 10)
-)
-
 type PrintJob struct {
 	UnprocessedImage Image
 	ProcessedImageID uuid.UUID
 
-	UUID uuid.UUID
+	UUID    uuid.UUID
+	owner   uint   // User.ID, also owns the images created while printing
+	token   uint   // api token the labels are counted on, 0 if none
+	charged string // Usage.Day the labels are counted on, empty if not charged
 
 	PFCount   uint
+	printed   uint // labels fed so far, the rest is refunded if the job fails
 	LabelSize image.Point
-	ditherer  Filter
+	Priority  int // higher is printed first
+	dither    string
+	ditherer  *dither.Ditherer // nil thresholds
+	filters   string           // fp.ParseFilters, applied after resizing
+	filter    fp.Filter        // nil if none
+
+	// printed instead of the image when set, executed from template and data
+	label       *fp.Label
+	template    string
+	data        []byte
+	templateYML []byte // source of template when queued
 
 	public     bool
 	optresize  bool
@@ -37,322 +49,381 @@ type PrintJob struct {
 	opttiling  bool
 }
 
-func init() {
-	go goPrintQ()
-}
-
-func goPrintQ() {
-	const totalSteps = 8
-
+// goPrintQ works off the queue of pr, started by setupPrinters
+func goPrintQ(pr *Printer) {
 	for {
-		select {
-		case job := <-printQ:
-			if *OptVerbose {
-				log.Printf("[printQ] Got printjob %+v", job)
-			}
+		job, ctx, cancel := nextJob(pr)
+		if *OptVerbose {
+			log.Printf("[printQ] Got printjob %+v for %s", job, pr.Name)
+		}
 
-			var start, stop chan struct{}
-			if *OptSupportMusic && GetConfig().MusicMinPF <= int(job.PFCount) {
-				start, stop = doaudio()
-			}
+		if job.label != nil {
+			printLabelJob(ctx, pr, job)
+		} else {
+			printImageJob(ctx, pr, job)
+		}
 
-			var currentimage = job.UnprocessedImage.UUID
+		pr.setRunning(uuid.Nil, nil)
+		finishJob(job.UUID)
+		refundQuota(job, job.PFCount-job.printed)
 
-			imageUpdateCh <- Status{
-				UUID:         job.UUID,
-				Step:         "decode",
-				Progress:     1.0 / totalSteps,
-				Done:         false,
-				CurrentImage: currentimage,
-			}
+		// don't leave half a job on the canvas for the next one
+		if ctx.Err() != nil {
+			clearCanvas(pr)
+		}
 
-			//TODO more options
-			var method = imaging.Lanczos
-			var imgchanged bool
+		cancel()
+	}
+}
 
-			img, _, err := image.Decode(bytes.NewReader(job.UnprocessedImage.Data))
-			if err != nil {
-				imageUpdateCh <- Status{
-					UUID:         job.UUID,
-					Step:         "Decode Image: " + err.Error(),
-					Progress:     -1,
-					Done:         true,
-					CurrentImage: currentimage,
-				}
+// clearCanvas clears the canvas of pr after a cancelled job, bounded by the
+// printer timeout as the job context is done already
+func clearCanvas(pr *Printer) {
+	ctx := context.Background()
+	if pr.conn.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pr.conn.Timeout)
+		defer cancel()
+	}
 
-				continue
-			}
+	err := pr.conn.Do(ctx, func(p *fp.Printer) error {
+		return p.ClearCanvasContext(ctx, -1)
+	})
+	if err != nil {
+		log.Printf("[printQ] Failed to clear canvas of %s: %s", pr.Name, err)
+	}
+}
 
-			size := img.Bounds().Size()
+// step of a failed job, jobs fail with the ctx error when cancelled
+func failedStep(ctx context.Context, step string, err error) string {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return "cancelled"
+	}
 
-			imageUpdateCh <- Status{
-				UUID:         job.UUID,
-				Step:         "rotating",
-				Progress:     2.0 / totalSteps,
-				Done:         false,
-				CurrentImage: currentimage,
-			}
-			if job.optrotate {
-				if *OptVerbose {
-					log.Printf("[printQ] testing rotate")
-				}
+	return step + err.Error()
+}
 
-				if (job.LabelSize.X > job.LabelSize.Y) != (size.X > size.Y) {
-					if *OptVerbose {
-						log.Printf("[printQ] rotating...")
-					}
+func printImageJob(ctx context.Context, pr *Printer, job *PrintJob) {
+	const totalSteps = 8
 
-					img = imaging.Rotate90(img)
-				}
+	var start, stop chan struct{}
+	if *OptSupportMusic && GetConfig().MusicMinPF <= int(job.PFCount) {
+		start, stop = doaudio()
+	}
 
-				imgchanged = true
-			}
+	var currentimage = job.UnprocessedImage.UUID
 
-			imageUpdateCh <- Status{
-				UUID:         job.UUID,
-				Step:         "resizing",
-				Progress:     3.0 / totalSteps,
-				Done:         false,
-				CurrentImage: currentimage,
-			}
-			if job.optresize {
-				if *OptVerbose {
-					log.Printf("[printQ] resize; stretch: %t", job.optstretch)
-				}
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "decode",
+		Progress:     1.0 / totalSteps,
+		Done:         false,
+		CurrentImage: currentimage,
+	}
 
-				if job.optstretch {
-					img = imaging.Resize(img, job.LabelSize.X, job.LabelSize.Y, method)
-				} else {
-					size = img.Bounds().Size()
+	src, _, err := image.Decode(bytes.NewReader(job.UnprocessedImage.Data))
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:         job.UUID,
+			Step:         "Decode Image: " + err.Error(),
+			Progress:     -1,
+			Done:         true,
+			CurrentImage: currentimage,
+		}
+
+		return
+	}
 
-					px := float32(size.X) / float32(job.LabelSize.X)
-					py := float32(size.Y) / float32(job.LabelSize.Y)
+	// progress of the steps of the rasterizer
+	steps := map[string]float32{"rotating": 2, "resizing": 3, "filtering": 3.5, "placing": 4, "dithering": 5}
 
-					if px > py {
-						img = imaging.Resize(img, job.LabelSize.X, 0, method)
-					} else {
-						img = imaging.Resize(img, 0, job.LabelSize.Y, method)
-					}
-				}
+	rast := &fp.Rasterizer{
+		LabelSize: job.LabelSize,
+		Fit:       fp.FitNone,
+		Rotate:    T(job.optrotate, fp.RotateAuto, fp.RotateNone),
+		AlignH:    T(job.optcenterh, fp.PlaceCenter, fp.PlaceStart),
+		AlignV:    T(job.optcenterv, fp.PlaceCenter, fp.PlaceStart),
+		Filter:    job.filter,
+		Dither:    job.ditherer,
 
-				imgchanged = true
+		Step: func(step string) {
+			if *OptVerbose {
+				log.Printf("[printQ] %s %s", job.UUID, step)
 			}
 
 			imageUpdateCh <- Status{
 				UUID:         job.UUID,
-				Step:         "centering",
-				Progress:     4.0 / totalSteps,
-				Done:         false,
+				Step:         step,
+				Progress:     steps[step] / totalSteps,
 				CurrentImage: currentimage,
 			}
-			if job.optcenterh || job.optcenterv {
-				if *OptVerbose {
-					log.Printf("[printQ] centerh %t centerv: %t", job.optcenterh, job.optcenterv)
-				}
+		},
+	}
 
-				nimg := imaging.New(job.LabelSize.X, job.LabelSize.Y, color.White)
-				size = img.Bounds().Size()
+	if job.optresize {
+		rast.Fit = T(job.optstretch, fp.FitStretch, fp.FitContain)
+	}
 
-				var x, y = 0, 0
-				if job.optcenterh {
-					x = job.LabelSize.X/2 - size.X/2
-				}
+	img, err := rast.Rasterize(src)
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:         job.UUID,
+			Step:         "Rasterize Image: " + err.Error(),
+			Progress:     -1,
+			Done:         true,
+			CurrentImage: currentimage,
+		}
 
-				if job.optcenterv {
-					y = job.LabelSize.Y/2 - size.Y/2
-				}
+		return
+	}
 
-				draw.Draw(nimg,
-					img.Bounds().Add(image.Pt(x, y)),
-					img,
-					image.Point{},
-					draw.Over,
-				)
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "saving",
+		Progress:     6.0 / totalSteps,
+		Done:         false,
+		CurrentImage: currentimage,
+	}
 
-				img = nimg
-				imgchanged = true
-			}
+	// save processed image
+	job.ProcessedImageID = uuid.New()
+	const encoding = "png"
+	buf := &bytes.Buffer{}
+	encodeImage(buf, img, encoding)
+
+	GetDB().Create(&Image{
+		UUID:        job.ProcessedImageID,
+		Owner:       job.owner,
+		UnProcessed: &job.UnprocessedImage.UUID,
+		Processed:   nil,
+
+		IsProcessed: true,
+		Ext:         encoding,
+		Data:        buf.Bytes(),
+		Public:      job.public,
+		Name:        job.UnprocessedImage.Name + "_processed",
+		Created:     time.Now(),
+	})
+
+	GetDB().Model(&Image{}).Where("UUID", job.UnprocessedImage.UUID).
+		Update("Processed", job.ProcessedImageID)
+
+	currentimage = job.ProcessedImageID
+
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "printing",
+		Progress:     7.0 / totalSteps,
+		CurrentImage: currentimage,
+		Preview: savePreview(job, func(p *fp.Printer) error {
+			return p.PrintChunked(img, 0, 0)
+		}),
+		Done: false,
+	}
+
+	log.Printf("[printQ] printing %d of size: %+v", job.PFCount-job.printed, img.Bounds().Size())
 
+	// PFCount of 0 is no print
+	if job.PFCount > 0 {
+		// chunks take the first half of the printing step
+		err = pr.conn.Do(ctx, func(p *fp.Printer) error {
+			return p.PrintChunkedProgress(ctx, img, 0, 0, func(sent, total int) {
+				imageUpdateCh <- Status{
+					UUID:         job.UUID,
+					Step:         fmt.Sprintf("printing: chunk %d of %d", sent, total),
+					Progress:     (7 + .5*float32(sent)/float32(total)) / totalSteps,
+					CurrentImage: currentimage,
+				}
+			})
+		})
+		if err != nil {
 			imageUpdateCh <- Status{
 				UUID:         job.UUID,
-				Step:         "dithering",
-				Progress:     5.0 / totalSteps,
-				Done:         false,
+				Step:         failedStep(ctx, "Uploading Data: ", err),
+				Progress:     -1,
+				Done:         true,
 				CurrentImage: currentimage,
 			}
-			if job.ditherer != nil {
-				if *OptVerbose {
-					log.Printf("[printQ] Dithering with %T", job.ditherer)
-				}
 
-				img = job.ditherer.Apply(img)
-				imgchanged = true
-			}
+			return
+		}
+	}
 
+	if start != nil {
+		<-start
+		log.Printf("start channel closed, start printing")
+	}
+
+	if job.PFCount > 0 {
+		err = printFeed(ctx, pr, job, func(fed uint) {
 			imageUpdateCh <- Status{
 				UUID:         job.UUID,
-				Step:         "saving",
-				Progress:     6.0 / totalSteps,
-				Done:         false,
+				Step:         fmt.Sprintf("printing: label %d of %d", fed, job.PFCount),
+				Progress:     (7.5 + .5*float32(fed)/float32(job.PFCount)) / totalSteps,
 				CurrentImage: currentimage,
 			}
-
-			// if image is unchanged, no need to save it again
-			if imgchanged {
-				// save processed image
-				job.ProcessedImageID = uuid.New()
-				const encoding = "png"
-				buf := &bytes.Buffer{}
-				encodeImage(buf, img, encoding)
-
-				GetDB().Create(&Image{
-					UUID:        job.ProcessedImageID,
-					UnProcessed: &job.UnprocessedImage.UUID,
-					Processed:   nil,
-
-					IsProcessed: true,
-					Ext:         encoding,
-					Data:        buf.Bytes(),
-					Public:      job.public,
-					Name:        job.UnprocessedImage.Name + "_processed",
-					Created:     time.Now(),
-				})
-
-				GetDB().Model(&Image{}).Where("UUID", job.UnprocessedImage.UUID).
-					Update("Processed", job.ProcessedImageID)
-
-				currentimage = job.ProcessedImageID
-			}
-
+		})
+		if err != nil {
 			imageUpdateCh <- Status{
 				UUID:         job.UUID,
-				Step:         "printing",
-				Progress:     7.0 / totalSteps,
+				Step:         failedStep(ctx, "", err),
+				Progress:     -1,
+				Done:         true,
 				CurrentImage: currentimage,
-				Done:         false,
 			}
 
-			log.Printf("[printQ] printing %d of size: %+v", job.PFCount, img.Bounds().Size())
-
-			if !*OptDryRun {
-				// PFCount of 0 is no print
-				if job.PFCount > 0 {
-					err = printer.PrintChunked(img, 0, 0)
-					if err != nil {
-						imageUpdateCh <- Status{
-							UUID:         job.UUID,
-							Step:         "Uploading Data: " + err.Error(),
-							Progress:     -1,
-							Done:         true,
-							CurrentImage: currentimage,
-						}
-
-						continue
-					}
-				}
+			return
+		}
+	} else {
+		log.Printf("job.PFCount is less than or equal 0, sleeping 1 sec")
+		time.Sleep(time.Second)
+	}
 
-				if start != nil {
-					<-start
-					log.Printf("start channel closed, start printing")
-				}
+	if stop != nil {
+		log.Printf("printing over, closing stop channel")
+		close(stop)
+	}
 
-				if job.PFCount > 0 {
-					err = printer.PF(job.PFCount)
-					if err != nil {
-						imageUpdateCh <- Status{
-							UUID:         job.UUID,
-							Step:         err.Error(),
-							Progress:     -1,
-							Done:         true,
-							CurrentImage: currentimage,
-						}
-
-						continue
-					}
-				} else {
-					log.Printf("job.PFCount is less than or equal 0, sleeping 1 sec")
-					time.Sleep(time.Second)
-				}
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "done",
+		Progress:     8 / totalSteps,
+		CurrentImage: currentimage,
+		Done:         true,
+	}
+}
 
-				if stop != nil {
-					log.Printf("printing over, closing stop channel")
-					close(stop)
-				}
-			} else {
-				conf := GetConfig()
-				ctype := T(*PrinterAddressType != "", *PrinterAddressType, conf.PrinterCType)
+func printLabelJob(ctx context.Context, pr *Printer, job *PrintJob) {
+	currentimage := job.UnprocessedImage.UUID
+
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "printing",
+		Progress:     0.5,
+		CurrentImage: currentimage,
+		Preview: savePreview(job, func(p *fp.Printer) error {
+			return p.PrintLabel(job.label, 0)
+		}),
+	}
 
-				if ctype == "serial" {
-					time.Sleep(time.Second * 12)
-				}
+	log.Printf("[printQ] printing label %d times", job.PFCount-job.printed)
 
-				if ctype == "net" {
-					time.Sleep(time.Second * 5)
-				}
-			}
+	uctx := ctx
+	if pr.conn.Timeout > 0 {
+		var cancel context.CancelFunc
+		uctx, cancel = context.WithTimeout(ctx, pr.conn.Timeout)
+		defer cancel()
+	}
 
-			imageUpdateCh <- Status{
-				UUID:         job.UUID,
-				Step:         "done",
-				Progress:     8 / totalSteps,
-				CurrentImage: currentimage,
-				Done:         true,
-			}
+	err := pr.conn.Do(uctx, func(p *fp.Printer) error {
+		return p.PrintLabelContext(uctx, job.label, 0)
+	})
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:         job.UUID,
+			Step:         failedStep(ctx, "Printing Label: ", err),
+			Progress:     -1,
+			Done:         true,
+			CurrentImage: currentimage,
 		}
+
+		return
 	}
-}
 
-func OpenPrinter() *fp.Printer {
-	conf := GetConfig()
+	err = printFeed(ctx, pr, job, func(fed uint) {
+		imageUpdateCh <- Status{
+			UUID:         job.UUID,
+			Step:         fmt.Sprintf("printing: label %d of %d", fed, job.PFCount),
+			Progress:     .5 + .5*float32(fed)/float32(job.PFCount),
+			CurrentImage: currentimage,
+		}
+	})
+	if err != nil {
+		imageUpdateCh <- Status{
+			UUID:         job.UUID,
+			Step:         failedStep(ctx, "Feeding Label: ", err),
+			Progress:     -1,
+			Done:         true,
+			CurrentImage: currentimage,
+		}
 
-	host := T(*PrinterAddressHost != "", *PrinterAddressHost, conf.PrinterHost)
-	port := T(*PrinterAddressPort != "", *PrinterAddressPort, conf.PrinterPort)
+		return
+	}
 
-	ctype := T(*PrinterAddressType != "", *PrinterAddressType, conf.PrinterCType)
+	imageUpdateCh <- Status{
+		UUID:         job.UUID,
+		Step:         "done",
+		Progress:     1,
+		CurrentImage: currentimage,
+		Done:         true,
+	}
+}
 
-	var err error
-	var p *fp.Printer
+// savePreview runs print against a mock printer of the jobs label size and
+// saves the resulting canvas; uuid.Nil if that failed
+func savePreview(job *PrintJob, print func(p *fp.Printer) error) uuid.UUID {
+	srv := fptest.NewServer(job.LabelSize.X, job.LabelSize.Y)
+	p := srv.Printer()
+	defer p.Conn.Close()
+
+	err := print(p)
+	if err != nil {
+		log.Printf("[printQ] Failed to render preview: %s", err)
+		return uuid.Nil
+	}
 
-	errors := 0
-loop:
-	for {
-		switch ctype {
-		case "net":
-			log.Printf("Dialing %s", host)
-			p, err = fp.DialPrinter(host)
-			if err == nil {
-				break loop
-			}
+	id := uuid.New()
+	buf := &bytes.Buffer{}
+	err = encodeImage(buf, srv.Canvas(), "png")
+	if err != nil {
+		log.Printf("[printQ] Failed to encode preview: %s", err)
+		return uuid.Nil
+	}
 
-			log.Printf("Error dialing %s: %s", host, err)
+	GetDB().Create(&Image{
+		UUID:        id,
+		Owner:       job.owner,
+		UnProcessed: &job.UnprocessedImage.UUID,
 
-		case "serial":
-			log.Printf("Open %s", port)
-			p, err = fp.OpenPrinter(port)
-			if err == nil {
-				break loop
-			}
+		IsProcessed: true,
+		Ext:         "png",
+		Data:        buf.Bytes(),
+		Public:      job.public,
+		Name:        job.UnprocessedImage.Name + "_preview",
+		Created:     time.Now(),
+	})
 
-			log.Printf("Error opening %s: %s", port, err)
+	return id
+}
 
-		default:
-			log.Fatalf("Invaid connection type '%s', choose between 'net' and 'serial'", ctype)
+// labels are fed one by one so a cancelled job stops after the current one,
+// each gets its own timeout; fed is called after every label with job.printed,
+// which is stored so a resumed job does not feed them again
+func printFeed(ctx context.Context, pr *Printer, job *PrintJob, fed func(n uint)) (err error) {
+	for i := job.printed; i < job.PFCount; i++ {
+		err = ctx.Err()
+		if err != nil {
+			return
 		}
 
-		time.Sleep(time.Second * 5)
-
-		errors++
-		if errors > 3 {
-			log.Fatalf("more than 3 errors, aborting: %s", err)
-		}
-	}
+		err = pr.conn.Do(ctx, func(p *fp.Printer) error {
+			fctx := ctx
+			if pr.conn.Timeout > 0 {
+				var cancel context.CancelFunc
+				fctx, cancel = context.WithTimeout(ctx, pr.conn.Timeout)
+				defer cancel()
+			}
 
-	if *OptBeep {
-		err := p.Beep(fp.Sound{Freq: 850, Dur: 200}, fp.Sound{Freq: 950, Dur: 200})
+			return p.PFContext(fctx, 1)
+		})
 		if err != nil {
-			log.Fatalf("Failed to communicate with printer: Beep: %s", err)
+			return
 		}
+
+		job.printed = i + 1
+		setPrinted(job.UUID, job.printed)
+		fed(job.printed)
 	}
 
-	return p
+	return
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"github.com/rileys-trash-can/libfp"
+	"github.com/rileys-trash-can/libfp/fptest"
+
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"sync"
+	"time"
+)
+
+// Printer is a configured printer with its own queue and worker
+type Printer struct {
+	PrinterConfig
+
+	conn  *fp.Reconnector
+	queue chan struct{} // wakes the worker, the queue itself is in the db
+
+	mu      sync.Mutex
+	running uuid.UUID          // job being printed
+	cancel  context.CancelFunc // cancels running
+}
+
+// in config order, the first one is the default
+var printers []*Printer
+
+// setupPrinters opens all configured printers and starts their workers
+func setupPrinters() {
+	confs := GetConfig().Printers
+	if len(confs) == 0 {
+		confs = []PrinterConfig{defaultPrinterConfig()}
+	}
+
+	for _, c := range confs {
+		if c.Name == "" {
+			log.Fatalf("Printer without name in config")
+		}
+
+		if GetPrinter(c.Name) != nil {
+			log.Fatalf("Printer '%s' configured twice", c.Name)
+		}
+
+		pr := &Printer{
+			PrinterConfig: c,
+			queue:         make(chan struct{}, 1),
+		}
+
+		if !*OptDryRun {
+			pr.conn = OpenPrinter(c)
+		} else {
+			pr.conn = DryRunPrinter(c)
+		}
+
+		printers = append(printers, pr)
+	}
+
+	resumeJobs()
+
+	for _, pr := range printers {
+		go goPrintQ(pr)
+
+		// jobs wait for the printer, the webinterface does not
+		go pr.conn.Connect(context.Background())
+	}
+}
+
+// the printer.* keys, overwritten by flags
+func defaultPrinterConfig() PrinterConfig {
+	conf := GetConfig()
+
+	return PrinterConfig{
+		Name: "default",
+		Host: T(*PrinterAddressHost != "", *PrinterAddressHost, conf.PrinterHost),
+		Port: T(*PrinterAddressPort != "", *PrinterAddressPort, conf.PrinterPort),
+		Type: T(*PrinterAddressType != "", *PrinterAddressType, conf.PrinterCType),
+
+		Timeout: conf.PrinterTimeout,
+	}
+}
+
+// GetPrinter returns the printer called name, the default one if name is
+// empty and nil if there is none
+func GetPrinter(name string) *Printer {
+	if name == "" && len(printers) > 0 {
+		return printers[0]
+	}
+
+	for _, pr := range printers {
+		if pr.Name == name {
+			return pr
+		}
+	}
+
+	return nil
+}
+
+// LabelSize returns the configured label size or the probed media size
+func (pr *Printer) LabelSize() (size image.Point, ok bool) {
+	if pr.Width > 0 && pr.Height > 0 {
+		return image.Pt(pr.Width, pr.Height), true
+	}
+
+	c := pr.conn.Caps()
+	if c == nil || c.Width <= 0 || c.Length <= 0 {
+		return
+	}
+
+	return image.Pt(c.Width, c.Length), true
+}
+
+// maxLabelDots limits labels of printers without a known media size, about
+// 50cm at 203dpi
+const maxLabelDots = 4000
+
+// checkLabelSize fails if labels of size do not fit the media of pr, or
+// maxLabelDots if it is unknown; the label is rendered in memory at size
+func (pr *Printer) checkLabelSize(size image.Point) error {
+	max, ok := pr.LabelSize()
+	if !ok {
+		max = image.Pt(maxLabelDots, maxLabelDots)
+	}
+
+	if size.X <= 0 || size.Y <= 0 || size.X > max.X || size.Y > max.Y {
+		return fmt.Errorf("label size %dx%d does not fit printer %s, at most %dx%d dots", size.X, size.Y, pr.Name, max.X, max.Y)
+	}
+
+	return nil
+}
+
+// Resolution returns the configured or probed dpi, 0 if unknown
+func (pr *Printer) Resolution() int {
+	if pr.DPI > 0 {
+		return pr.DPI
+	}
+
+	if c := pr.conn.Caps(); c != nil {
+		return c.DPI
+	}
+
+	return 0
+}
+
+func (pr *Printer) setRunning(id uuid.UUID, cancel context.CancelFunc) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.running, pr.cancel = id, cancel
+}
+
+// claim marks queued job id as printing and registers it as running in one
+// step, so CancelJob finds it either queued or running; false if it is no
+// longer queued
+func (pr *Printer) claim(id uuid.UUID, cancel context.CancelFunc) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	res := GetDB().Model(&Job{}).Where("uuid = ? AND state = ?", id, JobQueued).
+		Update("state", JobPrinting)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false
+	}
+
+	pr.running, pr.cancel = id, cancel
+	return true
+}
+
+// cancelRunning stops job id if it is the one being printed
+func (pr *Printer) cancelRunning(id uuid.UUID) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.running != id || pr.cancel == nil {
+		return false
+	}
+
+	pr.cancel()
+	return true
+}
+
+type PrinterInfo struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	DPI    int    `json:"dpi,omitempty"`
+	Queued int64  `json:"queued"`
+
+	Caps *fp.Capabilities `json:"caps,omitempty"`
+}
+
+func (pr *Printer) Info() *PrinterInfo {
+	size, _ := pr.LabelSize()
+
+	return &PrinterInfo{
+		Name:   pr.Name,
+		State:  pr.conn.State().String(),
+		Width:  size.X,
+		Height: size.Y,
+		DPI:    pr.Resolution(),
+		Queued: pr.Queued(),
+
+		Caps: pr.conn.Caps(),
+	}
+}
+
+// DryRunPrinter returns a printer backed by an in-process mock, responses
+// are delayed roughly like the configured connection type would be
+func DryRunPrinter(c PrinterConfig) *fp.Reconnector {
+	// large white 150x100 label, see fputils/configs.txt
+	srv := fptest.NewServer(orDefault(c.Width, 816), orDefault(c.Height, 1201))
+	srv.Caps.DPI = orDefault(c.DPI, srv.Caps.DPI)
+	srv.Verbose = *OptVerbose
+
+	switch c.Type {
+	case "serial":
+		srv.InjectDelay("PF", time.Second*12, 0)
+
+	case "net":
+		srv.InjectDelay("PF", time.Second*5, 0)
+	}
+
+	log.Printf("Dry run: using mock printer for %s", c.Name)
+
+	return newReconnector(c, func(ctx context.Context) (fp.PrinterConn, error) {
+		return srv.Pipe(), nil
+	})
+}
+
+// OpenPrinter returns a printer redialed whenever the connection breaks,
+// it connects on first use
+func OpenPrinter(c PrinterConfig) *fp.Reconnector {
+	switch c.Type {
+	case "net":
+		log.Printf("Using printer %s at %s", c.Name, c.Host)
+		return newReconnector(c, fp.DialFunc(c.Host))
+
+	case "serial":
+		log.Printf("Using printer %s at %s", c.Name, c.Port)
+		return newReconnector(c, fp.OpenFunc(c.Port))
+
+	default:
+		log.Fatalf("Invaid connection type '%s' of printer %s, choose between 'net' and 'serial'", c.Type, c.Name)
+	}
+
+	return nil
+}
+
+// beeps and probes every new connection
+func newReconnector(c PrinterConfig, dial func(ctx context.Context) (fp.PrinterConn, error)) *fp.Reconnector {
+	return &fp.Reconnector{
+		Dial:    dial,
+		Timeout: c.Timeout,
+
+		Setup: func(ctx context.Context, p *fp.Printer) error {
+			if *OptBeep {
+				err := p.BeepContext(ctx, fp.Sound{Freq: 850, Dur: 200}, fp.Sound{Freq: 950, Dur: 200})
+				if err != nil {
+					return fmt.Errorf("beep: %w", err)
+				}
+			}
+
+			caps, err := p.ProbeContext(ctx)
+			if err != nil {
+				log.Printf("Failed to probe printer %s: %s", c.Name, err)
+				return nil
+			}
+
+			log.Printf("Printer %s is %s (%s): %d dpi, media %dx%d dots",
+				c.Name, caps.Model, caps.Firmware, caps.DPI, caps.Width, caps.Length)
+
+			return nil
+		},
+
+		OnStateChange: func(state fp.ConnState, err error) {
+			if err != nil {
+				log.Printf("Printer %s %s: %s", c.Name, state, err)
+				return
+			}
+
+			log.Printf("Printer %s %s", c.Name, state)
+		},
+	}
+}
+
+func orDefault(v, def int) int {
+	if v != 0 {
+		return v
+	}
+
+	return def
+}
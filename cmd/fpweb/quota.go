@@ -0,0 +1,275 @@
+package main
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Usage counts the labels a user printed on a day, per api token; TokenID
+// is 0 for passwords and sessions
+type Usage struct {
+	UserID  uint   `gorm:"primaryKey;autoIncrement:false"`
+	TokenID uint   `gorm:"primaryKey;autoIncrement:false"`
+	Day     string `gorm:"primaryKey;size:10"` // 2006-01-02, sorts like dates
+	Labels  uint
+}
+
+// QuotaError is returned when a job would exceed a quota
+type QuotaError struct {
+	Period string // day / month
+	Limit  uint
+	Used   uint
+	Token  bool // the limit of the token was hit, not the users
+}
+
+func (e *QuotaError) Error() string {
+	who := "user"
+	if e.Token {
+		who = "token"
+	}
+
+	return fmt.Sprintf("%s quota of %d labels per %s exceeded, %d used", who, e.Limit, e.Period, e.Used)
+}
+
+// JobTooLargeError is returned for jobs with more labels than maxpfcount
+type JobTooLargeError struct {
+	PFCount, Max uint
+}
+
+func (e *JobTooLargeError) Error() string {
+	return fmt.Sprintf("%d labels requested, at most %d per job", e.PFCount, e.Max)
+}
+
+// check and count happen under usageMu so concurrent jobs can not overshoot
+var usageMu sync.Mutex
+
+// Quota is used and allowed labels per period, Limit 0 is unlimited
+type Quota struct {
+	Used  uint `json:"used"`
+	Limit uint `json:"limit"`
+}
+
+type QuotaInfo struct {
+	Day   Quota `json:"day"`
+	Month Quota `json:"month"`
+}
+
+// userLimits returns the label quotas of u, 0 is unlimited
+func userLimits(u *User) (day, month uint) {
+	if u.Admin {
+		return 0, 0
+	}
+
+	conf := GetConfig()
+
+	return quotaOr(u.DailyQuota, conf.QuotaDaily), quotaOr(u.MonthlyQuota, conf.QuotaMonthly)
+}
+
+// a user quota of 0 uses the config, negative ones are unlimited
+func quotaOr(q int, def uint) uint {
+	switch {
+	case q < 0:
+		return 0
+	case q == 0:
+		return def
+	}
+
+	return uint(q)
+}
+
+func periodStarts(now time.Time) (day, month string) {
+	return now.Format(time.DateOnly), now.Format("2006-01") + "-01"
+}
+
+func usedSince(column string, id uint, since string) (n uint) {
+	GetDB().Model(&Usage{}).Select("COALESCE(SUM(labels), 0)").
+		Where(column+" = ? AND day >= ?", id, since).Scan(&n)
+
+	return
+}
+
+// UserQuota returns the usage of u and its limits
+func UserQuota(u *User) *QuotaInfo {
+	day, month := periodStarts(time.Now())
+	dl, ml := userLimits(u)
+
+	return &QuotaInfo{
+		Day:   Quota{Used: usedSince("user_id", u.ID, day), Limit: dl},
+		Month: Quota{Used: usedSince("user_id", u.ID, month), Limit: ml},
+	}
+}
+
+// checkQuota returns an error if printing pf labels would exceed a limit of
+// u or t (which may be nil)
+func checkQuota(u *User, t *Token, pf uint) error {
+	if max := GetConfig().MaxPrintCount; max > 0 && pf > max && !u.Admin {
+		return &JobTooLargeError{PFCount: pf, Max: max}
+	}
+
+	day, month := periodStarts(time.Now())
+
+	check := func(column string, id uint, dl, ml uint, token bool) error {
+		for _, p := range []struct {
+			period, since string
+			limit         uint
+		}{{"day", day, dl}, {"month", month, ml}} {
+			if p.limit == 0 {
+				continue
+			}
+
+			used := usedSince(column, id, p.since)
+			if used+pf > p.limit {
+				return &QuotaError{Period: p.period, Limit: p.limit, Used: used, Token: token}
+			}
+		}
+
+		return nil
+	}
+
+	dl, ml := userLimits(u)
+	err := check("user_id", u.ID, dl, ml, false)
+	if err != nil || t == nil {
+		return err
+	}
+
+	return check("token_id", t.ID, t.DailyQuota, t.MonthlyQuota, true)
+}
+
+// jobOwner returns the owner of job, anonymous if auth is disabled
+func jobOwner(job *PrintJob) (*User, error) {
+	var u User
+	res := GetDB().Where("id = ?", job.owner).Limit(1).Find(&u)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 { // auth is disabled
+		return anonymous, nil
+	}
+
+	return &u, nil
+}
+
+// chargeQuota checks the quotas of the owner of job and counts its labels on
+// today, which is remembered in job.charged for refundQuota
+func chargeQuota(job *PrintJob) error {
+	if job.PFCount == 0 {
+		return nil
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	u, err := jobOwner(job)
+	if err != nil {
+		return err
+	}
+
+	var t *Token
+	if job.token != 0 {
+		t = new(Token)
+		err := GetDB().Where("id = ?", job.token).First(t).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkQuota(u, t, job.PFCount)
+	if err != nil {
+		return err
+	}
+
+	day, _ := periodStarts(time.Now())
+
+	err = GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "token_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]any{"labels": gorm.Expr("labels + ?", job.PFCount)}),
+	}).Create(&Usage{UserID: job.owner, TokenID: job.token, Day: day, Labels: job.PFCount}).Error
+	if err != nil {
+		return err
+	}
+
+	job.charged = day
+	return nil
+}
+
+// refundQuota takes n labels of job that were not printed off the usage
+// they were counted on
+func refundQuota(job *PrintJob, n uint) {
+	if n == 0 || job.charged == "" {
+		return
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	err := GetDB().Model(&Usage{}).
+		Where("user_id = ? AND token_id = ? AND day = ?", job.owner, job.token, job.charged).
+		Update("labels", gorm.Expr("CASE WHEN labels > ? THEN labels - ? ELSE 0 END", n, n)).Error
+	if err != nil {
+		log.Printf("[quota] Failed to refund %d labels of job %s: %s", n, job.UUID, err)
+	}
+}
+
+// ratelimit is a token bucket per user, api token or address
+type ratelimit struct {
+	sync.Mutex
+
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var printLimit = &ratelimit{buckets: make(map[string]*bucket)}
+
+// Allow takes a request from the bucket of key, it returns how long to wait
+// if it is empty
+func (rl *ratelimit) Allow(key string, perMinute, burst int) (ok bool, wait time.Duration) {
+	return rl.take(key, perMinute, burst, 1)
+}
+
+// Peek is Allow without taking a request
+func (rl *ratelimit) Peek(key string, perMinute, burst int) (ok bool, wait time.Duration) {
+	return rl.take(key, perMinute, burst, 0)
+}
+
+func (rl *ratelimit) take(key string, perMinute, burst int, n float64) (ok bool, wait time.Duration) {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	rate := float64(perMinute) / float64(time.Minute)
+
+	b, exists := rl.buckets[key]
+	if !exists {
+		// full buckets are forgotten, they are recreated full
+		if len(rl.buckets) > 1024 {
+			for k, b := range rl.buckets {
+				if b.tokens+float64(now.Sub(b.last))*rate >= float64(burst) {
+					delete(rl.buckets, k)
+				}
+			}
+		}
+
+		b = &bucket{tokens: float64(burst), last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = min(float64(burst), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+
+	b.tokens -= n
+	return true, 0
+}
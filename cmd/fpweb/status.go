@@ -3,36 +3,59 @@ package main
 import (
 	"fmt"
 	"github.com/google/uuid"
-	"log"
-	"time"
 )
 
 var (
-	newImageCh       = make(chan uuid.UUID, 1)
+	newImageCh       = make(chan StatusNew, 1)
 	imageUpdateCh    = make(chan Status, 1)
 	getImageStatusCh = make(chan StatusReq, 1)
+	subscribeCh      = make(chan StatusSub)
 )
 
+// StatusNew creates the status of a job owned by Owner
+type StatusNew struct {
+	UUID  uuid.UUID
+	Owner uint
+}
+
 type StatusReq struct {
 	UUID uuid.UUID
 
 	ResCh chan *Status
 }
 
+// StatusSub adds or removes Ch from the subscribers of UUIDs updates
+type StatusSub struct {
+	UUID uuid.UUID
+
+	Ch     chan *Status
+	Remove bool
+}
+
 type Status struct {
 	UUID uuid.UUID `json:"jobid,omitempty"`
 
 	Step         string    `json:"message,omitempty"`
 	CurrentImage uuid.UUID `json:"image,omitempty"`
+	Preview      uuid.UUID `json:"preview,omitempty"` // rendering of what is sent to the printer
 	Done         bool      `json:"done,omitempty"`
 	Progress     float32   `json:"progress,omitempty"`
-	updated      time.Time `json:"-"`
+
+	// read from the job, updates leave them unchanged
+	Printer  string `json:"printer,omitempty"`
+	State    string `json:"state,omitempty"`
+	Priority int    `json:"priority"`
+	Owner    uint   `json:"-"`
 }
 
 func (s *Status) String() string {
 	return fmt.Sprintf("%s %.2f%%", s.Step, s.Progress*100)
 }
 
+func (s *Status) HasPreview() bool {
+	return s.Preview != uuid.Nil
+}
+
 func GetStatus(uuid uuid.UUID) *Status {
 	r := StatusReq{}
 
@@ -43,45 +66,89 @@ func GetStatus(uuid uuid.UUID) *Status {
 	return <-r.ResCh
 }
 
+// SubscribeStatus returns a channel receiving every update of job id
+// until UnsubscribeStatus; it is closed early if the reader falls behind
+func SubscribeStatus(id uuid.UUID) chan *Status {
+	ch := make(chan *Status, 64)
+	subscribeCh <- StatusSub{UUID: id, Ch: ch}
+
+	return ch
+}
+
+func UnsubscribeStatus(id uuid.UUID, ch chan *Status) {
+	subscribeCh <- StatusSub{UUID: id, Ch: ch, Remove: true}
+}
+
 func init() {
 	go doStatus()
 }
 
+// doStatus serialises status updates, they are stored with the job in the db
 func doStatus() {
-	// move status and job managment to database
+	subs := make(map[uuid.UUID][]chan *Status)
+
+	// removes and closes ch unless it already was
+	remove := func(id uuid.UUID, ch chan *Status) {
+		for i, c := range subs[id] {
+			if c == ch {
+				subs[id] = append(subs[id][:i], subs[id][i+1:]...)
+				if len(subs[id]) == 0 {
+					delete(subs, id)
+				}
 
-	const livetime = time.Hour
-	statusMap := make(map[uuid.UUID]*Status)
-	t := time.NewTicker(livetime / 2)
+				close(ch)
+				return
+			}
+		}
+	}
 
-	for {
+	publish := func(id uuid.UUID) {
+		if len(subs[id]) == 0 {
+			return
+		}
 
-		select {
-		case now := <-t.C:
-			for k, s := range statusMap {
-				if s.updated.Add(livetime).Before(now) {
-					log.Printf("[jobclean] removing job %s last updated %s", s.UUID, s.updated)
+		// complete with the fields of the job
+		s := loadStatus(id)
+		if s == nil {
+			return
+		}
 
-					delete(statusMap, k)
-				}
+		for _, ch := range append([]chan *Status(nil), subs[id]...) {
+			select {
+			case ch <- s:
+			default:
+				remove(id, ch)
 			}
+		}
+	}
 
+	for {
+		select {
 		case n := <-newImageCh:
-			statusMap[n] = &Status{
-				UUID: n,
+			saveStatus(&Status{
+				UUID:  n.UUID,
+				Owner: n.Owner,
 
 				Step:     "created",
 				Progress: 0,
-				updated:  time.Now(),
-			}
+			})
 
-		case update := <-imageUpdateCh:
-			update.updated = time.Now()
+			publish(n.UUID)
 
-			statusMap[update.UUID] = &update
+		case update := <-imageUpdateCh:
+			saveStatus(&update)
+			publish(update.UUID)
 
 		case r := <-getImageStatusCh:
-			r.ResCh <- statusMap[r.UUID]
+			r.ResCh <- loadStatus(r.UUID)
+
+		case sub := <-subscribeCh:
+			if sub.Remove {
+				remove(sub.UUID, sub.Ch)
+				continue
+			}
+
+			subs[sub.UUID] = append(subs[sub.UUID], sub.Ch)
 		}
 	}
 }
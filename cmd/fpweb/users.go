@@ -0,0 +1,280 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// User owns the images and jobs created with its credentials
+type User struct {
+	ID      uint      `gorm:"primaryKey" json:"id"`
+	Name    string    `gorm:"uniqueIndex;size:64" json:"name"`
+	Hash    []byte    `json:"-"`     // bcrypt of the password
+	Admin   bool      `json:"admin"` // sees and controls everything
+	Created time.Time `json:"created"`
+
+	// labels, 0 uses quota.* from the config, negative is unlimited
+	DailyQuota   int `json:"dailyquota"`
+	MonthlyQuota int `json:"monthlyquota"`
+}
+
+// Token is an API token or a login session, only its hash is stored
+type Token struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	Hash     string    `gorm:"uniqueIndex;size:64" json:"-"`
+	UserID   uint      `gorm:"index" json:"-"`
+	Name     string    `json:"name"`
+	Session  bool      `json:"session"` // created by /login
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"` // zero never
+	LastUsed time.Time `json:"lastused"`
+
+	// labels printed with this token, 0 is unlimited; the quota of the user
+	// applies as well
+	DailyQuota   uint `json:"dailyquota"`
+	MonthlyQuota uint `json:"monthlyquota"`
+}
+
+const (
+	sessionCookie = "fpweb_session"
+	sessionTTL    = time.Hour * 24 * 30
+)
+
+// every request is done as anonymous if auth.disabled is set
+var anonymous = &User{Name: "anonymous", Admin: true}
+
+// Owns reports whether u may see and control what owner created
+func (u *User) Owns(owner uint) bool {
+	return u != nil && (u.Admin || u.ID == owner)
+}
+
+// CanView reports whether u may see img
+func (u *User) CanView(img *Image) bool {
+	return img.Public || u.Owns(img.Owner)
+}
+
+func (u *User) SetPassword(password string) (err error) {
+	if len(password) < 8 {
+		return errors.New("password too short, at least 8 characters")
+	}
+
+	u.Hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(u.Hash, []byte(password)) == nil
+}
+
+// visibleImages restricts db to the images u may see, the result can be
+// reused for several queries
+func visibleImages(db *gorm.DB, u *User) *gorm.DB {
+	switch {
+	case u == nil:
+		db = db.Where("public = ?", true)
+
+	case !u.Admin:
+		db = db.Where("public = ? OR owner = ?", true, u.ID)
+	}
+
+	return db.Session(&gorm.Session{})
+}
+
+func CreateUser(name, password string, admin bool) (u *User, err error) {
+	if name == "" {
+		return nil, errors.New("empty user name")
+	}
+
+	u = &User{
+		Name:    name,
+		Admin:   admin,
+		Created: time.Now(),
+	}
+
+	err = u.SetPassword(password)
+	if err != nil {
+		return
+	}
+
+	err = GetDB().Create(u).Error
+	return
+}
+
+// GetUser returns the user called name, nil if there is none
+func GetUser(name string) *User {
+	var u User
+	res := GetDB().Where("name = ?", name).Limit(1).Find(&u)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil
+	}
+
+	return &u
+}
+
+func Users() (users []User, err error) {
+	err = GetDB().Order("name").Find(&users).Error
+	return
+}
+
+// DeleteUser removes a user and its tokens, its images and jobs are kept
+func DeleteUser(name string) error {
+	u := GetUser(name)
+	if u == nil {
+		return errors.New("unknown user " + name)
+	}
+
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", u.ID).Delete(&Token{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(u).Error
+	})
+}
+
+// compared against for unknown users, so they take as long as wrong
+// passwords and do not reveal which names exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func userByPassword(name, password string) *User {
+	u := GetUser(name)
+	if u == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil
+	}
+
+	if !u.CheckPassword(password) {
+		return nil
+	}
+
+	return u
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(h[:])
+}
+
+// NewToken creates a token for u, the secret is not stored and only
+// returned here
+func NewToken(u *User, name string, session bool, day, month uint) (secret string, t *Token, err error) {
+	b := make([]byte, 24)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	t = &Token{
+		Hash:    hashToken(secret),
+		UserID:  u.ID,
+		Name:    name,
+		Session: session,
+		Created: time.Now(),
+
+		DailyQuota:   day,
+		MonthlyQuota: month,
+	}
+
+	if session {
+		t.Expires = t.Created.Add(sessionTTL)
+	}
+
+	err = GetDB().Create(t).Error
+	return
+}
+
+// userByToken returns the token secret and its owner, nil if it is unknown
+// or expired
+func userByToken(secret string) (*User, *Token) {
+	var t Token
+	res := GetDB().Where("hash = ?", hashToken(secret)).Limit(1).Find(&t)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if !t.Expires.IsZero() && now.After(t.Expires) {
+		return nil, nil
+	}
+
+	// not every request needs a write
+	if now.Sub(t.LastUsed) > time.Minute {
+		GetDB().Model(&t).Update("last_used", now)
+	}
+
+	var u User
+	res = GetDB().Where("id = ?", t.UserID).Limit(1).Find(&u)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return &u, &t
+}
+
+// Tokens returns the api tokens of u, sessions are left out
+func Tokens(u *User) (tokens []Token, err error) {
+	err = GetDB().Where("user_id = ? AND session = ?", u.ID, false).Order("created").Find(&tokens).Error
+	return
+}
+
+// DeleteToken revokes token id of u
+func DeleteToken(u *User, id uint) error {
+	res := GetDB().Where("id = ? AND user_id = ?", id, u.ID).Delete(&Token{})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return errors.New("unknown token")
+	}
+
+	return nil
+}
+
+// deleteSession logs out the session secret
+func deleteSession(secret string) {
+	GetDB().Where("hash = ? AND session = ?", hashToken(secret), true).Delete(&Token{})
+}
+
+// setupUsers creates an admin with a random password if there are no users
+func setupUsers() {
+	if GetConfig().AuthDisabled {
+		log.Printf("Authentication is disabled, everyone is admin")
+		return
+	}
+
+	var n int64
+	err := GetDB().Model(&User{}).Count(&n).Error
+	if err != nil {
+		log.Fatalf("Failed to count users: %s", err)
+	}
+
+	if n > 0 {
+		return
+	}
+
+	b := make([]byte, 12)
+	_, err = rand.Read(b)
+	if err != nil {
+		log.Fatalf("Failed to generate password: %s", err)
+	}
+
+	password := base64.RawURLEncoding.EncodeToString(b)
+	_, err = CreateUser("admin", password, true)
+	if err != nil {
+		log.Fatalf("Failed to create admin: %s", err)
+	}
+
+	log.Printf("Created user 'admin' with password '%s', change it after logging in", password)
+}
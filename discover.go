@@ -0,0 +1,159 @@
+package fp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Found is a printer that answered a Fingerprint query
+type Found struct {
+	Addr     string `json:"addr"` // host:port, usable with DialPrinter
+	Model    string `json:"model,omitempty"`
+	Firmware string `json:"firmware,omitempty"`
+}
+
+// Scanner looks for printers by connecting to every address of a subnet
+type Scanner struct {
+	Port    int           // DefaultPort if zero
+	Workers int           // concurrent connections, 64 if zero
+	Timeout time.Duration // per address, 2s if zero
+}
+
+// Discover scans cidr on DefaultPort, see Scanner.Discover
+func Discover(ctx context.Context, cidr string) ([]Found, error) {
+	return (&Scanner{}).Discover(ctx, cidr)
+}
+
+// Discover connects to every host address of cidr and sends
+// PRINT VERSION$(0) and PRINT VERSION$(1) to those accepting. Only endpoints
+// echoing the query and answering "Ok" are returned, sorted by address.
+// Raw printers without an interpreter may print the query.
+func (s *Scanner) Discover(ctx context.Context, cidr string) (found []Found, err error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return
+	}
+
+	// a /16 at most
+	prefix = prefix.Masked()
+	if prefix.Addr().BitLen()-prefix.Bits() > 16 {
+		return nil, fmt.Errorf("fp: subnet %s too large, at most 65536 addresses are scanned", cidr)
+	}
+
+	port := orDefault(s.Port, DefaultPort)
+	timeout := T(s.Timeout > 0, s.Timeout, 2*time.Second)
+
+	addrs := make(chan netip.Addr)
+	go func() {
+		defer close(addrs)
+
+		for a := prefix.Addr(); prefix.Contains(a); a = a.Next() {
+			if !hostAddr(prefix, a) {
+				continue
+			}
+
+			select {
+			case addrs <- a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for i := 0; i < orDefault(s.Workers, 64); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for a := range addrs {
+				f, ok := probeAddr(ctx, net.JoinHostPort(a.String(), strconv.Itoa(port)), timeout)
+				if !ok {
+					continue
+				}
+
+				mu.Lock()
+				found = append(found, f)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	sort.Slice(found, func(i, j int) bool {
+		a, _ := netip.ParseAddrPort(found[i].Addr)
+		b, _ := netip.ParseAddrPort(found[j].Addr)
+
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c < 0
+		}
+
+		return a.Port() < b.Port()
+	})
+
+	return found, ctx.Err()
+}
+
+// network and broadcast addresses of IPv4 subnets are skipped
+func hostAddr(prefix netip.Prefix, a netip.Addr) bool {
+	if !a.Is4() || prefix.Bits() >= 31 {
+		return true
+	}
+
+	if a == prefix.Addr() {
+		return false
+	}
+
+	b := a.As4()
+	last := prefix.Addr().As4()
+	for i := range last {
+		shift := max(0, min(8, prefix.Bits()-i*8))
+		last[i] |= byte(0xff >> shift)
+	}
+
+	return b != last
+}
+
+func probeAddr(ctx context.Context, addr string, timeout time.Duration) (f Found, ok bool) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	p := NewPrinter(conn)
+
+	for _, q := range []struct {
+		cmd string
+		dst *string
+	}{
+		{`PRINT VERSION$(0)`, &f.Firmware},
+		{`PRINT VERSION$(1)`, &f.Model},
+	} {
+		res, err := p.ExecContext(ctx, q.cmd)
+		if err != nil || res.Command != q.cmd {
+			return
+		}
+
+		if len(res.Response) > 0 {
+			*q.dst = res.Response[0]
+		}
+	}
+
+	f.Addr = addr
+	return f, true
+}
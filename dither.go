@@ -0,0 +1,74 @@
+package fp
+
+import (
+	// image stuffs
+	"github.com/makeworld-the-better-one/dither/v2"
+	"image/color"
+
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SerpentineSuffix makes error diffusion ditherers alternate direction every
+// row, e.g. "floydsteinberg-serpentine"; this avoids diagonal artifacts
+const SerpentineSuffix = "-serpentine"
+
+// ordered and noise ditherers
+var ditherMappers = map[string]func() dither.PixelMapper{
+	"o4x4":   func() dither.PixelMapper { return dither.PixelMapperFromMatrix(dither.ClusteredDot4x4, 1.0) },
+	"noise":  func() dither.PixelMapper { return dither.RandomNoiseGrayscale(.1, .5) },
+	"bayer":  func() dither.PixelMapper { return dither.Bayer(3, 3, .6) },
+	"bayer8": func() dither.PixelMapper { return dither.Bayer(8, 8, 1.0) },
+}
+
+// error diffusion ditherers, better for photos and logos
+var ditherMatrices = map[string]dither.ErrorDiffusionMatrix{
+	"floydsteinberg": dither.FloydSteinberg,
+	"atkinson":       dither.Atkinson,
+	"jjn":            dither.JarvisJudiceNinke,
+	"stucki":         dither.Stucki,
+	"sierra":         dither.Sierra,
+	"sierra2":        dither.TwoRowSierra,
+	"sierralite":     dither.SierraLite,
+	"burkes":         dither.Burkes,
+}
+
+// DitherNames returns the names understood by DitherFromString, sorted;
+// error diffusion ones also take SerpentineSuffix
+func DitherNames() (names []string) {
+	for n := range ditherMappers {
+		names = append(names, n)
+	}
+
+	for n := range ditherMatrices {
+		names = append(names, n)
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// DitherFromString returns a black and white ditherer by name, see
+// DitherNames; "" and "none" return nil
+func DitherFromString(name string) (d *dither.Ditherer, err error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+
+	d = dither.NewDitherer([]color.Color{color.White, color.Black})
+
+	if mapper, ok := ditherMappers[name]; ok {
+		d.Mapper = mapper()
+		return
+	}
+
+	base, serpentine := strings.CutSuffix(name, SerpentineSuffix)
+	if matrix, ok := ditherMatrices[base]; ok {
+		d.Matrix = matrix
+		d.Serpentine = serpentine
+		return
+	}
+
+	return nil, fmt.Errorf("unknown dither '%s', one of none, %s", name, strings.Join(DitherNames(), ", "))
+}
@@ -0,0 +1,176 @@
+package fp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// error codes as listed in the Fingerprint programmers reference
+const (
+	ECSyntax              = 1
+	ECUnbalancedParens    = 2
+	ECNotImplemented      = 3
+	ECEvaluationSyntax    = 4
+	ECUnrecognizedToken   = 5
+	ECLineTooLong         = 6
+	ECUndefinedIdentifier = 12
+	ECIllegalValue        = 1001
+	ECFieldOutOfLabel     = 1003
+	ECOutOfPaper          = 1005
+	ECNoFieldToPrint      = 1006
+	ECHardware            = 1010
+	ECFontNotFound        = 1019
+	ECHeadLifted          = 1022
+	ECOutOfRibbon         = 1027
+	ECNextLabelNotFound   = 1031
+	ECFileNotFound        = 1037
+	ECImageNotFound       = 1046
+)
+
+var errorCodes = map[int]string{
+	ECSyntax:              "Syntax error",
+	ECUnbalancedParens:    "Unbalanced parentheses",
+	ECNotImplemented:      "Feature not implemented",
+	ECEvaluationSyntax:    "Evaluation syntax error",
+	ECUnrecognizedToken:   "Unrecognized token",
+	ECLineTooLong:         "Tokenized line too long",
+	ECUndefinedIdentifier: "Undefined identifier",
+	ECIllegalValue:        "Illegal value",
+	ECFieldOutOfLabel:     "Field out of label",
+	ECOutOfPaper:          "Out of paper",
+	ECNoFieldToPrint:      "No field to print",
+	ECHardware:            "Hardware error",
+	ECFontNotFound:        "Font not found",
+	ECHeadLifted:          "Head lifted",
+	ECOutOfRibbon:         "Out of transfer ribbon",
+	ECNextLabelNotFound:   "Next label not found",
+	ECFileNotFound:        "File not found",
+	ECImageNotFound:       "Image not found",
+}
+
+// sentinels for use with errors.Is, matching is done by Code only
+var (
+	ErrSyntax              = &FingerprintError{Code: ECSyntax}
+	ErrNotImplemented      = &FingerprintError{Code: ECNotImplemented}
+	ErrUndefinedIdentifier = &FingerprintError{Code: ECUndefinedIdentifier}
+	ErrIllegalValue        = &FingerprintError{Code: ECIllegalValue}
+	ErrFieldOutOfLabel     = &FingerprintError{Code: ECFieldOutOfLabel}
+	ErrOutOfPaper          = &FingerprintError{Code: ECOutOfPaper}
+	ErrNoFieldToPrint      = &FingerprintError{Code: ECNoFieldToPrint}
+	ErrHardware            = &FingerprintError{Code: ECHardware}
+	ErrFontNotFound        = &FingerprintError{Code: ECFontNotFound}
+	ErrHeadLifted          = &FingerprintError{Code: ECHeadLifted}
+	ErrOutOfRibbon         = &FingerprintError{Code: ECOutOfRibbon}
+	ErrNextLabelNotFound   = &FingerprintError{Code: ECNextLabelNotFound}
+	ErrFileNotFound        = &FingerprintError{Code: ECFileNotFound}
+	ErrImageNotFound       = &FingerprintError{Code: ECImageNotFound}
+)
+
+// FingerprintError is returned when the printer answered a command with
+// anything but "Ok"
+type FingerprintError struct {
+	Code    int    // 0 if the status could not be mapped to a code
+	Message string // printers message or the known text for Code
+
+	Command string // echoed command
+	Status  string // raw status line
+}
+
+func (e *FingerprintError) Error() string {
+	msg := T(e.Message == "", ErrorText(e.Code), e.Message)
+
+	if e.Command == "" {
+		return fmt.Sprintf("fingerprint: error %d: %s", e.Code, msg)
+	}
+
+	return fmt.Sprintf("fingerprint: '%s': error %d: %s", e.Command, e.Code, msg)
+}
+
+func (e *FingerprintError) Is(target error) bool {
+	t, ok := target.(*FingerprintError)
+	if !ok {
+		return false
+	}
+
+	return t.Code != 0 && t.Code == e.Code
+}
+
+// Known reports whether Code is in the table of known error codes
+func (e *FingerprintError) Known() bool {
+	_, ok := errorCodes[e.Code]
+	return ok
+}
+
+// ErrorText returns the known message for code or "" if unknown
+func ErrorText(code int) string {
+	return errorCodes[code]
+}
+
+// ParseStatus parses a status line as sent by the printer after each command.
+// Returns nil if the status is "Ok". Understood formats are
+// "Error 1003", "Error 1003: Field out of label", "E1003" and the bare message.
+func ParseStatus(status string) *FingerprintError {
+	s := strings.TrimSpace(status)
+	if strings.EqualFold(s, "Ok") {
+		return nil
+	}
+
+	e := &FingerprintError{Status: status}
+
+	rest, ok := cutPrefixFold(s, "error")
+	if !ok && len(s) > 1 && (s[0] == 'E' || s[0] == 'e') && isDigit(s[1]) {
+		rest, ok = s[1:], true
+	}
+
+	if ok {
+		rest = strings.TrimLeft(rest, " #:")
+
+		n := 0
+		for n < len(rest) && isDigit(rest[n]) {
+			n++
+		}
+
+		if n > 0 {
+			e.Code, _ = strconv.Atoi(rest[:n])
+			e.Message = strings.TrimSpace(strings.TrimLeft(rest[n:], " :-"))
+		} else {
+			e.Message = strings.TrimSpace(rest)
+		}
+	} else {
+		e.Message = s
+	}
+
+	// look up missing code or message
+	if e.Message == "" {
+		e.Message = errorCodes[e.Code]
+	}
+
+	if e.Code == 0 {
+		msg := strings.TrimRight(e.Message, ".")
+		for code, txt := range errorCodes {
+			if strings.EqualFold(txt, msg) {
+				e.Code = code
+				break
+			}
+		}
+	}
+
+	if e.Message == "" {
+		e.Message = "unknown error"
+	}
+
+	return e
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+
+	return s[len(prefix):], true
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
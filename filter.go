@@ -0,0 +1,268 @@
+package fp
+
+import (
+	// image stuffs
+	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/dither/v2"
+	"image"
+	"image/color"
+
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Filter processes an image before it is printed, see ParseFilters
+type Filter interface {
+	Apply(img image.Image) image.Image
+}
+
+type FilterFunc func(img image.Image) image.Image
+
+func (f FilterFunc) Apply(img image.Image) image.Image {
+	return f(img)
+}
+
+// Filters applies its filters in order
+type Filters []Filter
+
+func (fs Filters) Apply(img image.Image) image.Image {
+	for _, f := range fs {
+		img = f.Apply(img)
+	}
+
+	return img
+}
+
+// Brightness changes the brightness by percent, -100 to 100
+func Brightness(percent float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		return imaging.AdjustBrightness(img, percent)
+	})
+}
+
+// Contrast changes the contrast by percent, -100 to 100
+func Contrast(percent float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		return imaging.AdjustContrast(img, percent)
+	})
+}
+
+// Gamma corrects the gamma, above 1 lightens and below darkens
+func Gamma(gamma float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		return imaging.AdjustGamma(img, gamma)
+	})
+}
+
+// Invert swaps black and white
+func Invert() Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		return imaging.Invert(img)
+	})
+}
+
+// AutoLevels stretches the brightness so the darkest pixels become black and
+// the brightest white, clip percent of the pixels on either end are ignored
+func AutoLevels(clip float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		hist := imaging.Histogram(img)
+		frac := clip / 100
+
+		lo, sum := 0, 0.0
+		for ; lo < 255; lo++ {
+			sum += hist[lo]
+			if sum > frac {
+				break
+			}
+		}
+
+		hi, sum := 255, 0.0
+		for ; hi > lo; hi-- {
+			sum += hist[hi]
+			if sum > frac {
+				break
+			}
+		}
+
+		if hi <= lo { // one color
+			return img
+		}
+
+		var lut [256]uint8
+		for i := range lut {
+			lut[i] = clamp8(float64(i-lo) * 255 / float64(hi-lo))
+		}
+
+		return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+			return color.NRGBA{lut[c.R], lut[c.G], lut[c.B], c.A}
+		})
+	})
+}
+
+// UnsharpMask sharpens edges by adding amount times the difference to a
+// gaussian blur of radius sigma, amount 1 is a good start
+func UnsharpMask(sigma, amount float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		src := imaging.Clone(img)
+		blur := imaging.Blur(src, sigma)
+
+		for i := range src.Pix {
+			if i%4 == 3 { // alpha
+				continue
+			}
+
+			v := float64(src.Pix[i])
+			src.Pix[i] = clamp8(v + amount*(v-float64(blur.Pix[i])))
+		}
+
+		return src
+	})
+}
+
+// Threshold maps every pixel to black or white without dithering, pixels
+// darker than cutoff (0 to 1) become black
+func Threshold(cutoff float64) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		b := img.Bounds()
+		out := image.NewGray(b)
+		limit := uint16(cutoff * 0xffff)
+
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y >= limit {
+					out.SetGray(x, y, color.Gray{Y: 0xff})
+				}
+			}
+		}
+
+		return out
+	})
+}
+
+// Dither reduces the image to black and white with d, see DitherFromString
+func Dither(d *dither.Ditherer) Filter {
+	return FilterFunc(func(img image.Image) image.Image {
+		return d.Dither(img)
+	})
+}
+
+func clamp8(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+
+	return uint8(v + .5)
+}
+
+// ParseFilters parses a comma separated chain of filters, applied in order:
+//
+//	brightness=<percent>   -100 to 100
+//	contrast=<percent>     -100 to 100
+//	gamma=<gamma>          above 1 lightens
+//	autolevels[=<clip>]    percent of pixels ignored on either end, default 0.5
+//	unsharp=<sigma>[:<amount>]  amount defaults to 1
+//	invert
+//	threshold[=<cutoff>]   0 to 1, default 0.5
+//	dither=<name>          see DitherFromString
+//
+// e.g. "autolevels,gamma=1.2,unsharp=1.5,threshold=0.6"; "" is no filter
+func ParseFilters(s string) (fs Filters, err error) {
+	nan := math.NaN()
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, arg, hasArg := strings.Cut(part, "=")
+
+		// def NaN requires a value
+		num := func(def, lo, hi float64) (v float64, err error) {
+			if !hasArg {
+				if math.IsNaN(def) { // required
+					return 0, fmt.Errorf("filter %s needs a value", name)
+				}
+
+				return def, nil
+			}
+
+			v, err = strconv.ParseFloat(arg, 64)
+			if err != nil || v < lo || v > hi {
+				return 0, fmt.Errorf("filter %s: value '%s' not within %g and %g", name, arg, lo, hi)
+			}
+
+			return
+		}
+
+		var f Filter
+		var v float64
+
+		switch name {
+		case "brightness":
+			v, err = num(nan, -100, 100)
+			f = Brightness(v)
+
+		case "contrast":
+			v, err = num(nan, -100, 100)
+			f = Contrast(v)
+
+		case "gamma":
+			v, err = num(nan, 0.01, 100)
+			f = Gamma(v)
+
+		case "autolevels":
+			v, err = num(0.5, 0, 50)
+			f = AutoLevels(v)
+
+		case "unsharp":
+			sigma, amount, ok := strings.Cut(arg, ":")
+
+			arg = sigma
+			v, err = num(nan, 0.1, 100)
+			if err != nil {
+				break
+			}
+
+			a := 1.0
+			if ok {
+				arg, hasArg = amount, true
+				a, err = num(nan, 0, 10)
+			}
+
+			f = UnsharpMask(v, a)
+
+		case "invert":
+			f = Invert()
+
+		case "threshold":
+			v, err = num(0.5, 0, 1)
+			f = Threshold(v)
+
+		case "dither":
+			var d *dither.Ditherer
+			d, err = DitherFromString(arg)
+			if d == nil && err == nil {
+				continue
+			}
+
+			f = Dither(d)
+
+		default:
+			err = fmt.Errorf("unknown filter '%s'", name)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		fs = append(fs, f)
+	}
+
+	return
+}
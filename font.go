@@ -0,0 +1,97 @@
+package fp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// font selected by TextStyle if none is given; standard on current
+// Fingerprint printers
+var DefaultFont = "Swiss 721 BT"
+
+// TextStyle is applied together with the text it styles, so the printers
+// previous FONT, MAG, DIR, ALIGN and II / NI state does not matter
+type TextStyle struct {
+	Font  string // FONT name; DefaultFont if empty
+	Size  int    // in points; 12 if zero
+	Slant int    // in degrees
+
+	// MAG horizontal and vertical magnification 1-4; 1 if zero
+	MagX, MagY int
+
+	Direction Direction // DirLeftToRight if zero
+	Align     Align     // AlignBottomLeft if zero
+	Inverse   bool      // white on black
+}
+
+func (s *TextStyle) Validate() error {
+	switch {
+	case s.Size < 0:
+		return fmt.Errorf("fp: invalid font size %d", s.Size)
+
+	case s.Slant <= -90 || s.Slant >= 90:
+		return fmt.Errorf("fp: invalid slant %d", s.Slant)
+
+	case s.MagX < 0 || s.MagX > 4 || s.MagY < 0 || s.MagY > 4:
+		return fmt.Errorf("fp: invalid magnification %d,%d", s.MagX, s.MagY)
+
+	case s.Direction < 0 || s.Direction > DirBottomToTop:
+		return fmt.Errorf("fp: invalid direction %d", s.Direction)
+
+	case s.Align < 0 || s.Align > AlignTopRight:
+		return fmt.Errorf("fp: invalid alignment %d", s.Align)
+	}
+
+	return nil
+}
+
+// FONT "<name>",<size>,<slant>:MAG <x>,<y>:DIR <d>:ALIGN <a>:II|NI
+func (s *TextStyle) statement() string {
+	font := T(s.Font == "", DefaultFont, s.Font)
+
+	return fmt.Sprintf("FONT %s,%d,%d:MAG %d,%d:DIR %d:ALIGN %d:%s",
+		Quote(font), orDefault(s.Size, 12), s.Slant,
+		orDefault(s.MagX, 1), orDefault(s.MagY, 1),
+		orDefault(int(s.Direction), int(DirLeftToRight)),
+		orDefault(int(s.Align), int(AlignBottomLeft)),
+		T(s.Inverse, "II", "NI"),
+	)
+}
+
+// PRTextStyled prints txt at the current position using style
+func (p *Printer) PRTextStyled(txt string, style *TextStyle) (err error) {
+	return p.PRTextStyledContext(context.Background(), txt, style)
+}
+
+func (p *Printer) PRTextStyledContext(ctx context.Context, txt string, style *TextStyle) (err error) {
+	err = style.Validate()
+	if err != nil {
+		return
+	}
+
+	_, err = p.ExecContext(ctx, style.statement()+":PRTXT "+Quote(txt))
+	return
+}
+
+// FONTS
+// returns the names of all fonts installed on the printer
+func (p *Printer) Fonts() (fonts []string, err error) {
+	return p.FontsContext(context.Background())
+}
+
+func (p *Printer) FontsContext(ctx context.Context) (fonts []string, err error) {
+	res, err := p.ExecContext(ctx, "FONTS")
+	if err != nil {
+		return
+	}
+
+	for _, l := range res.Response {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			fonts = append(fonts, l)
+		}
+	}
+
+	return
+}
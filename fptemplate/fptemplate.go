@@ -0,0 +1,377 @@
+// Package fptemplate implements a declarative YAML format for labels.
+// Strings in a template are text/template templates executed with the data
+// the label is printed with, a field can be repeated once for every element
+// of a list.
+//
+//	width: 800
+//	height: 1200
+//	fields:
+//	  - type: text
+//	    x: 40
+//	    y: 1100
+//	    font: Swiss 721 Bold BT
+//	    size: 14
+//	    text: "Serial {{.SerialNo}}"
+//	  - type: text
+//	    x: 40
+//	    y: 1000
+//	    range: .Items
+//	    step: [0, -40]
+//	    text: "{{.Count}}x {{.Name}}"
+//	  - type: barcode
+//	    x: 40
+//	    y: 200
+//	    barcode: CODE128
+//	    data: "{{.SerialNo}}"
+package fptemplate
+
+import (
+	"github.com/rileys-trash-can/libfp"
+	"gopkg.in/yaml.v2"
+
+	// image stuffs
+	_ "github.com/rileys-trash-can/libfp/prbuf"
+	_ "golang.org/x/image/bmp"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Template is a parsed label template
+type Template struct {
+	Name   string `yaml:"name"`
+	Width  int    `yaml:"width"`
+	Height int    `yaml:"height"`
+	DPI    int    `yaml:"dpi"`
+
+	Fields []*Field `yaml:"fields"`
+
+	// images are loaded from FS; the templates directory when using Load
+	FS fs.FS `yaml:"-"`
+
+	// Source is the YAML the template was parsed from, to execute the
+	// same template later even if the file changed
+	Source []byte `yaml:"-"`
+}
+
+// Field describes one or, using Range, several fields of a label. Which keys
+// are used depends on Type; text, data and image are templates.
+type Field struct {
+	Type string `yaml:"type"` // text, barcode, image, line or box
+
+	X         int          `yaml:"x"`
+	Y         int          `yaml:"y"`
+	Direction fp.Direction `yaml:"direction"`
+	Align     fp.Align     `yaml:"align"`
+
+	// repeat the field for every element of the list this pipeline returns,
+	// dot is set to the element; each repetition is moved by Step
+	Range string `yaml:"range"`
+	Step  [2]int `yaml:"step"`
+
+	// text, every line of the result is printed as its own field
+	Text       string `yaml:"text"`
+	Font       string `yaml:"font"`
+	Size       int    `yaml:"size"`
+	Slant      int    `yaml:"slant"`
+	MagX       int    `yaml:"magx"`
+	MagY       int    `yaml:"magy"`
+	Inverse    bool   `yaml:"inverse"`
+	LineHeight int    `yaml:"lineheight"` // 1.2 times the font size if zero
+
+	// barcode
+	Barcode       fp.Symbology `yaml:"barcode"`
+	Data          string       `yaml:"data"`
+	RatioLarge    int          `yaml:"ratiolarge"`
+	RatioSmall    int          `yaml:"ratiosmall"`
+	Enlargement   int          `yaml:"enlargement"`
+	SecurityLevel int          `yaml:"security"`
+	HumanReadable bool         `yaml:"humanreadable"`
+
+	// image, a path relative to the template
+	Image string `yaml:"image"`
+
+	// line and box; Height is the bar height of barcodes too
+	Length    int  `yaml:"length"`
+	Width     int  `yaml:"width"`
+	Height    int  `yaml:"height"`
+	Thickness int  `yaml:"thickness"`
+	Radius    int  `yaml:"radius"`
+	Fill      bool `yaml:"fill"`
+
+	text, data, image, rng *template.Template
+}
+
+// Load reads the template at path, images are loaded relative to it
+func Load(path string) (t *Template, err error) {
+	d, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	t, err = Parse(d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	t.FS = os.DirFS(filepath.Dir(path))
+	if t.Name == "" {
+		t.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	return
+}
+
+// Parse parses a YAML template and all templates in its fields
+func Parse(d []byte) (t *Template, err error) {
+	t = &Template{}
+
+	err = yaml.UnmarshalStrict(d, t)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Source = d
+
+	if t.Width <= 0 || t.Height <= 0 {
+		return nil, fmt.Errorf("invalid label size %dx%d", t.Width, t.Height)
+	}
+
+	for i, f := range t.Fields {
+		err = f.parse()
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %w", i, err)
+		}
+	}
+
+	return
+}
+
+func (f *Field) parse() (err error) {
+	switch f.Type {
+	case "text", "barcode", "image", "line", "box":
+	default:
+		return fmt.Errorf("unknown field type '%s'", f.Type)
+	}
+
+	f.text, err = parse(f.Text)
+	if err != nil {
+		return
+	}
+
+	f.data, err = parse(f.Data)
+	if err != nil {
+		return
+	}
+
+	f.image, err = parse(f.Image)
+	if err != nil {
+		return
+	}
+
+	if f.Range != "" {
+		f.rng, err = template.New("").Funcs(template.FuncMap{
+			"collect": func(v any) string { return "" },
+		}).Parse("{{range $v := " + f.Range + "}}{{collect $v}}{{end}}")
+	}
+
+	return
+}
+
+func parse(s string) (*template.Template, error) {
+	return template.New("").Option("missingkey=error").Parse(s)
+}
+
+// Execute fills in data and returns the resulting label
+func (t *Template) Execute(data any) (l *fp.Label, err error) {
+	l = &fp.Label{
+		Size: image.Pt(t.Width, t.Height),
+		DPI:  t.DPI,
+	}
+
+	for i, f := range t.Fields {
+		items := []any{data}
+		if f.rng != nil {
+			items, err = f.items(data)
+			if err != nil {
+				return nil, fmt.Errorf("field %d: range: %w", i, err)
+			}
+		}
+
+		for n, item := range items {
+			pos := image.Pt(f.X+n*f.Step[0], f.Y+n*f.Step[1])
+
+			var fields []fp.Field
+			fields, err = t.fields(f, pos, item)
+			if err != nil {
+				return nil, fmt.Errorf("field %d: %w", i, err)
+			}
+
+			l.Fields = append(l.Fields, fields...)
+		}
+	}
+
+	return l, l.Validate()
+}
+
+// elements of the list f.Range returns
+func (f *Field) items(data any) (items []any, err error) {
+	rng, err := f.rng.Clone()
+	if err != nil {
+		return
+	}
+
+	rng.Funcs(template.FuncMap{
+		"collect": func(v any) string {
+			items = append(items, v)
+			return ""
+		},
+	})
+
+	err = rng.Execute(&bytes.Buffer{}, data)
+	return
+}
+
+func (t *Template) fields(f *Field, pos image.Point, data any) (fields []fp.Field, err error) {
+	switch f.Type {
+	case "text":
+		var txt string
+		txt, err = execute(f.text, data)
+		if err != nil {
+			return
+		}
+
+		style := fp.TextStyle{
+			Font: f.Font, Size: f.Size, Slant: f.Slant,
+			MagX: f.MagX, MagY: f.MagY,
+			Direction: f.Direction, Align: f.Align, Inverse: f.Inverse,
+		}
+
+		lh := f.LineHeight
+		if lh == 0 {
+			dpi := t.DPI
+			if dpi == 0 {
+				dpi = fp.DefaultDPI
+			}
+
+			lh = orDefault(f.Size, 12) * orDefault(f.MagY, 1) * dpi * 12 / 72 / 10
+		}
+
+		for i, line := range strings.Split(strings.TrimRight(txt, "\n"), "\n") {
+			fields = append(fields, &fp.TextField{
+				Pos:   pos.Add(nextLine(f.Direction, i*lh)),
+				Text:  line,
+				Style: style,
+			})
+		}
+
+	case "barcode":
+		var d string
+		d, err = execute(f.data, data)
+		if err != nil {
+			return
+		}
+
+		fields = append(fields, &fp.BarcodeField{
+			Pos: pos,
+			Barcode: fp.Barcode{
+				Type: f.Barcode, Data: d,
+				RatioLarge: f.RatioLarge, RatioSmall: f.RatioSmall,
+				Enlargement: f.Enlargement, Height: f.Height,
+				SecurityLevel: f.SecurityLevel, HumanReadable: f.HumanReadable,
+			},
+			Direction: f.Direction,
+			Align:     f.Align,
+		})
+
+	case "image":
+		var name string
+		name, err = execute(f.image, data)
+		if err != nil {
+			return
+		}
+
+		var img image.Image
+		img, err = t.loadImage(name)
+		if err != nil {
+			return
+		}
+
+		fields = append(fields, &fp.ImageField{Pos: pos, Image: img, Align: f.Align})
+
+	case "line":
+		fields = append(fields, &fp.LineField{
+			Pos: pos, Length: f.Length, Thickness: f.Thickness,
+			Direction: f.Direction, Align: f.Align,
+		})
+
+	case "box":
+		fields = append(fields, &fp.BoxField{
+			Pos: pos, Width: f.Width, Height: f.Height,
+			Thickness: f.Thickness, Radius: f.Radius, Fill: f.Fill,
+			Direction: f.Direction, Align: f.Align,
+		})
+	}
+
+	return
+}
+
+func (t *Template) loadImage(name string) (img image.Image, err error) {
+	if t.FS == nil {
+		return nil, errors.New("no file system to load images from")
+	}
+
+	f, err := t.FS.Open(name)
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	img, _, err = image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return
+}
+
+func execute(t *template.Template, data any) (string, error) {
+	buf := &bytes.Buffer{}
+	err := t.Execute(buf, data)
+
+	return buf.String(), err
+}
+
+// offset of a line dist below the first one, along the text direction
+func nextLine(d fp.Direction, dist int) image.Point {
+	switch d {
+	case fp.DirTopToBottom:
+		return image.Pt(-dist, 0)
+
+	case fp.DirRightToLeft:
+		return image.Pt(0, dist)
+
+	case fp.DirBottomToTop:
+		return image.Pt(dist, 0)
+	}
+
+	return image.Pt(0, -dist)
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+
+	return v
+}
@@ -0,0 +1,494 @@
+// Package fptest implements an in-process Fingerprint printer for tests and
+// dry runs. It speaks the echo / response / status framing fp.Printer
+// expects, records every command, renders the label using fp.Interpreter and
+// can be told to fail or stall on specific commands.
+package fptest
+
+import (
+	"github.com/rileys-trash-can/libfp"
+
+	"image"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a mock printer, the zero value is not usable; use NewServer
+type Server struct {
+	// Size of the canvas in dots
+	Size image.Point
+
+	// log every command received
+	Verbose bool
+
+	// installed fonts, FONT fails for any other
+	Fonts []string
+
+	// answers to the queries of fp.Printer.Probe, payloads larger than
+	// FreeMemory are refused
+	Caps fp.Capabilities
+
+	mu       sync.Mutex
+	commands []string
+	interp   *fp.Interpreter
+	vars     map[string]string
+
+	faults []*fault
+}
+
+type fault struct {
+	match  string
+	status string
+	delay  time.Duration
+	times  int // <= 0 is unlimited
+}
+
+// NewServer returns a mock printer with a canvas of w x h dots
+func NewServer(w, h int) *Server {
+	s := &Server{
+		Size: image.Pt(w, h),
+
+		Fonts: []string{
+			"Swiss 721 BT", "Swiss 721 Bold BT", "Century Schoolbook BT",
+			"Dutch 801 Roman BT", "Monospace 821 BT", "OCR-A BT", "OCR-B 10 BT",
+		},
+
+		Caps: fp.Capabilities{
+			Model:      "PM43",
+			Firmware:   "Fingerprint 10.0.0 (fptest)",
+			DPI:        fp.DefaultDPI,
+			Width:      w,
+			Length:     h,
+			FreeMemory: 8 << 20,
+		},
+
+		vars: make(map[string]string),
+	}
+
+	s.interp = fp.NewInterpreter(s.Size, s.Caps.DPI)
+
+	return s
+}
+
+// Printer returns a fp.Printer connected to s through an in-memory pipe
+func (s *Server) Printer() *fp.Printer {
+	return fp.NewPrinter(s.Pipe())
+}
+
+// Pipe returns the client end of an in-memory connection served by s
+func (s *Server) Pipe() net.Conn {
+	client, server := net.Pipe()
+
+	go s.ServeConn(server)
+
+	return client
+}
+
+// Listen starts serving on a random local TCP port and returns its address
+func (s *Server) Listen() (l net.Listener, err error) {
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+
+	go s.Serve(l)
+
+	return
+}
+
+// Serve accepts connections on l until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn handles commands on c until it is closed
+func (s *Server) ServeConn(c io.ReadWriteCloser) error {
+	defer c.Close()
+
+	// responses are written asynchronously like a socket buffer would,
+	// net.Pipe would deadlock a client writing before reading otherwise
+	resCh := make(chan []byte, 64)
+	defer close(resCh)
+
+	go func() {
+		for b := range resCh {
+			_, err := c.Write(b)
+			if err != nil {
+				c.Close()
+			}
+		}
+	}()
+
+	r := bufio.NewReader(c)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) {
+				return nil
+			}
+
+			return err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		if s.Verbose {
+			log.Printf("[fptest] %s", line)
+		}
+
+		res, status, err := s.exec(line, r)
+
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "%s"+fp.CRLF, line)
+		for _, l := range res {
+			fmt.Fprintf(buf, "%s"+fp.CRLF, l)
+		}
+
+		fmt.Fprintf(buf, fp.CRLF+"%s"+fp.CRLF, status)
+
+		resCh <- buf.Bytes()
+
+		// the connection broke within a payload
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// InjectError makes the next times commands starting with match fail with
+// the Fingerprint error code; times <= 0 fails them forever
+func (s *Server) InjectError(match string, code int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := fmt.Sprintf("Error %d", code)
+	if txt := fp.ErrorText(code); txt != "" {
+		status += ": " + txt
+	}
+
+	s.faults = append(s.faults, &fault{match: match, status: status, times: times})
+}
+
+// InjectDelay delays the response to commands starting with match;
+// times <= 0 delays them forever
+func (s *Server) InjectDelay(match string, d time.Duration, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &fault{match: match, delay: d, times: times})
+}
+
+// ClearFaults removes all injected errors and delays
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Commands returns all command lines received so far
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.commands...)
+}
+
+// Canvas returns a copy of the current canvas
+func (s *Server) Canvas() image.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.interp.Canvas()
+}
+
+// Labels returns a copy of the canvas for every label fed with PF
+func (s *Server) Labels() []image.Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var labels []image.Image
+	for _, l := range s.interp.Labels() {
+		labels = append(labels, l)
+	}
+
+	return labels
+}
+
+// Reset forgets commands, labels, faults and settings; a changed Size
+// takes effect
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = nil
+	s.faults = nil
+	s.vars = make(map[string]string)
+	s.interp = fp.NewInterpreter(s.Size, s.Caps.DPI)
+}
+
+// executes line, reading binary payloads from r; err is only set if
+// reading a payload failed and the connection is unusable
+func (s *Server) exec(line string, r *bufio.Reader) (res []string, status string, err error) {
+	stmts := SplitStatements(line)
+
+	s.mu.Lock()
+	mem := s.Caps.FreeMemory
+	s.mu.Unlock()
+
+	// payloads are read before locking, a slow client must not block
+	// Commands, Canvas and friends
+	payloads := make([][]byte, len(stmts))
+	for i, stmt := range stmts {
+		n := payloadSize(stmt)
+		if n == 0 {
+			continue
+		}
+
+		// the payload of a negative size can not be told from the
+		// following commands, drop what arrived with it
+		if n < 0 {
+			r.Discard(r.Buffered())
+			return nil, errStatus(fp.ErrIllegalValue), nil
+		}
+
+		// larger than the printer could store, skip it without buffering
+		if n > mem {
+			_, err = io.CopyN(io.Discard, r, int64(n))
+			return nil, errStatus(fp.ErrIllegalValue), err
+		}
+
+		payloads[i] = make([]byte, n)
+		_, err = io.ReadFull(r, payloads[i])
+		if err != nil {
+			return nil, errStatus(fp.ErrIllegalValue), err
+		}
+	}
+
+	s.mu.Lock()
+	s.commands = append(s.commands, line)
+	f := s.fault(line)
+
+	status = "Ok"
+
+	// injected errors have no side effects
+	if f == nil || f.status == "" {
+		for i, stmt := range stmts {
+			out, err := s.statement(stmt, bytes.NewReader(payloads[i]))
+			res = append(res, out...)
+
+			if err != nil {
+				status = errStatus(err)
+				break
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	if f != nil {
+		time.Sleep(f.delay)
+
+		if f.status != "" {
+			status = f.status
+		}
+	}
+
+	return
+}
+
+// payloadSize returns the declared size of the binary data following stmt,
+// 0 if none; it may be negative
+func payloadSize(stmt string) int {
+	name, args := splitCommand(stmt)
+
+	var size string
+	switch name {
+	case "IMAGE":
+		// IMAGE LOAD <nexp>,"name",<size>,""
+		load, ok := strings.CutPrefix(args, "LOAD")
+		if !ok {
+			return 0
+		}
+
+		parts := strings.Split(load, ",")
+		if len(parts) < 3 {
+			return 0
+		}
+
+		size = parts[2]
+
+	case "PRBUF":
+		// PRBUF <size>[,<nexp>]
+		size, _, _ = strings.Cut(args, ",")
+
+	default:
+		return 0
+	}
+
+	n, _ := strconv.Atoi(strings.TrimSpace(size))
+	return n
+}
+
+// must hold s.mu
+func (s *Server) fault(line string) (f *fault) {
+	for i, ff := range s.faults {
+		if !strings.HasPrefix(line, ff.match) {
+			continue
+		}
+
+		if ff.times > 0 {
+			ff.times--
+			if ff.times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+
+		return ff
+	}
+
+	return nil
+}
+
+// must hold s.mu, r holds the payload of stmt
+func (s *Server) statement(stmt string, r io.Reader) (res []string, err error) {
+	name, args := splitCommand(stmt)
+
+	switch name {
+	case "IMAGE":
+		// IMAGE LOAD <nexp>,"name",<size>,"", the payload is discarded
+		if !strings.HasPrefix(args, "LOAD") {
+			return
+		}
+
+		if payloadSize(stmt) <= 0 {
+			err = fp.ErrSyntax
+			return
+		}
+
+	case "FONT", "FT":
+		name, _, _ := strings.Cut(args, ",")
+		name = fp.Unquote(strings.TrimSpace(name))
+
+		if !slices.Contains(s.Fonts, name) {
+			return nil, fp.ErrFontNotFound
+		}
+
+		err = s.interp.Exec(stmt, r)
+
+	case "FONTS":
+		res = append(res, s.Fonts...)
+
+	case "PRINT", "?":
+		res = append(res, s.eval(args))
+
+	case "SETUP":
+		// SETUP GET "<node>",<var>
+		get, ok := strings.CutPrefix(args, "GET ")
+		if !ok {
+			return
+		}
+
+		i := strings.LastIndex(get, ",")
+		if i < 0 {
+			return nil, fp.ErrSyntax
+		}
+
+		node, v := get[:i], get[i+1:]
+
+		val, ok := s.setup(fp.Unquote(strings.TrimSpace(node)))
+		if !ok {
+			return nil, fp.ErrIllegalValue
+		}
+
+		s.vars[strings.ToUpper(strings.TrimSpace(v))] = val
+
+	default:
+		// the printer accepts much more than the interpreter renders
+		err = s.interp.Exec(stmt, r)
+		if errors.Is(err, fp.ErrNotImplemented) {
+			err = nil
+		}
+	}
+
+	return
+}
+
+// values of the setup tree derived from Caps
+func (s *Server) setup(node string) (string, bool) {
+	switch strings.ToUpper(node) {
+	case "PRINTING,PRINT RESOLUTION":
+		return strconv.Itoa(s.Caps.DPI), s.Caps.DPI > 0
+
+	case "MEDIA,MEDIA SIZE,WIDTH":
+		return strconv.Itoa(s.Caps.Width), s.Caps.Width > 0
+
+	case "MEDIA,MEDIA SIZE,LENGTH":
+		return strconv.Itoa(s.Caps.Length), s.Caps.Length > 0
+	}
+
+	return "", false
+}
+
+// string literals, variables, VERSION$ and FRE
+func (s *Server) eval(expr string) string {
+	expr = strings.TrimSpace(expr)
+
+	switch up := strings.ToUpper(expr); {
+	case strings.HasPrefix(up, `"`):
+		return fp.Unquote(expr)
+
+	case up == "VERSION$(0)" || up == "VERSION$":
+		return s.Caps.Firmware
+
+	case up == "VERSION$(1)":
+		return s.Caps.Model
+
+	case strings.HasPrefix(up, "FRE("):
+		return strconv.Itoa(s.Caps.FreeMemory)
+	}
+
+	return s.vars[strings.ToUpper(expr)]
+}
+
+// SplitStatements splits a command line on colons outside of quotes
+func SplitStatements(line string) []string {
+	return fp.SplitStatements(line)
+}
+
+func splitCommand(stmt string) (name, args string) {
+	name, args, _ = strings.Cut(stmt, " ")
+
+	return strings.ToUpper(name), strings.TrimSpace(args)
+}
+
+func errStatus(err error) string {
+	var fperr *fp.FingerprintError
+	if errors.As(err, &fperr) {
+		return fmt.Sprintf("Error %d: %s", fperr.Code, fp.ErrorText(fperr.Code))
+	}
+
+	return fmt.Sprintf("Error %d: %s", fp.ECIllegalValue, err)
+}
@@ -0,0 +1,202 @@
+package fptest
+
+import (
+	"github.com/rileys-trash-can/libfp"
+
+	"image"
+
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// black pixels on the canvas
+func inked(img image.Image) (n int) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r < 0x8000 {
+				n++
+			}
+		}
+	}
+
+	return
+}
+
+func TestExecContext(t *testing.T) {
+	srv := NewServer(200, 100)
+	p := srv.Printer()
+
+	res, err := p.ExecContext(context.Background(), "PRINT VERSION$(0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Response) != 1 || res.Response[0] != srv.Caps.Firmware {
+		t.Errorf("response %q, want %q", res.Response, srv.Caps.Firmware)
+	}
+
+	_, err = p.ExecContext(context.Background(), "PP 10,10:PL 50,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(srv.Commands(), []string{"PRINT VERSION$(0)", "PP 10,10:PL 50,5"}) {
+		t.Errorf("commands %q", srv.Commands())
+	}
+
+	if inked(srv.Canvas()) == 0 {
+		t.Error("line not drawn")
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	srv := NewServer(200, 100)
+	p := srv.Printer()
+
+	srv.InjectError("PP", fp.ECFieldOutOfLabel, 1)
+
+	_, err := p.ExecContext(context.Background(), "PP 10,10:PL 50,5")
+
+	var fperr *fp.FingerprintError
+	if !errors.As(err, &fperr) || fperr.Code != fp.ECFieldOutOfLabel {
+		t.Fatalf("error %v, want code %d", err, fp.ECFieldOutOfLabel)
+	}
+
+	if !errors.Is(err, fp.ErrFieldOutOfLabel) {
+		t.Errorf("%v is not ErrFieldOutOfLabel", err)
+	}
+
+	if n := inked(srv.Canvas()); n != 0 {
+		t.Errorf("failed command drew %d dots", n)
+	}
+
+	// only once
+	_, err = p.ExecContext(context.Background(), "PP 10,10:PL 50,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inked(srv.Canvas()) == 0 {
+		t.Error("line not drawn")
+	}
+}
+
+func TestInjectDelay(t *testing.T) {
+	srv := NewServer(200, 100)
+	p := srv.Printer()
+
+	srv.InjectDelay("PRINT", 500*time.Millisecond, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := p.ExecContext(ctx, "PRINT VERSION$(1)")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want deadline exceeded", err)
+	}
+
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("returned after %s, not at the deadline", d)
+	}
+
+	// the late response is skipped
+	res, err := p.ExecContext(context.Background(), "PRINT VERSION$(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Response) != 1 || res.Response[0] != srv.Caps.Model {
+		t.Errorf("response %q, want %q", res.Response, srv.Caps.Model)
+	}
+}
+
+// a client stalling within a payload must not block the accessors
+func TestStalledPayload(t *testing.T) {
+	srv := NewServer(200, 100)
+	c := srv.Pipe()
+	defer c.Close()
+
+	// returns once the server read it, then give it time to wait for the rest
+	_, err := c.Write([]byte("PRBUF 100" + fp.CRLF + "\x40\x02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		srv.Commands()
+		srv.Canvas()
+		srv.Labels()
+		srv.InjectError("PF", fp.ECOutOfPaper, 1)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("accessors blocked by a stalled payload")
+	}
+}
+
+// invalid payload sizes fail the command and leave the connection usable
+func TestPayloadSize(t *testing.T) {
+	srv := NewServer(200, 100)
+	srv.Caps.FreeMemory = 16
+
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"negative", "PRBUF -1" + fp.CRLF},
+		{"too large", "PRBUF 100" + fp.CRLF + strings.Repeat("x", 100)},
+	}
+
+	// the status follows the echo and responses after an empty line
+	status := func(r *bufio.Reader) string {
+		var prev string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			line = strings.TrimRight(line, fp.CRLF)
+			if prev == "" && (line == "Ok" || strings.HasPrefix(line, "Error")) {
+				return line
+			}
+
+			prev = line
+		}
+	}
+
+	for _, tt := range tests {
+		c := srv.Pipe()
+		r := bufio.NewReader(c)
+
+		go c.Write([]byte(tt.payload))
+
+		want := fmt.Sprintf("Error %d", fp.ECIllegalValue)
+		if st := status(r); !strings.HasPrefix(st, want) {
+			t.Errorf("%s: got %q, want %s", tt.name, st, want)
+		}
+
+		go c.Write([]byte("PP 10,10" + fp.CRLF))
+
+		if st := status(r); st != "Ok" {
+			t.Errorf("%s: after the payload got %q, want Ok", tt.name, st)
+		}
+
+		c.Close()
+	}
+}
@@ -0,0 +1,140 @@
+package fp
+
+import (
+	"context"
+	"fmt"
+)
+
+// Direction of text, barcodes, lines and images relative to the label; DIR
+type Direction int
+
+const (
+	DirLeftToRight Direction = iota + 1 // default
+	DirTopToBottom
+	DirRightToLeft
+	DirBottomToTop
+)
+
+// Align selects which point of a field is placed at the insertion point,
+// laid out like a numeric keypad; ALIGN
+type Align int
+
+const (
+	AlignBottomLeft Align = iota + 1 // default
+	AlignBottomCenter
+	AlignBottomRight
+	AlignMiddleLeft
+	AlignCenter
+	AlignMiddleRight
+	AlignTopLeft
+	AlignTopCenter
+	AlignTopRight
+)
+
+// DIR <nexp>
+func (p *Printer) SetDirection(d Direction) (err error) {
+	return p.SetDirectionContext(context.Background(), d)
+}
+
+func (p *Printer) SetDirectionContext(ctx context.Context, d Direction) (err error) {
+	if d < DirLeftToRight || d > DirBottomToTop {
+		return fmt.Errorf("fp: invalid direction %d", d)
+	}
+
+	_, err = p.ExecContext(ctx, fmt.Sprintf("DIR %d", d))
+	return
+}
+
+// ALIGN <nexp>
+func (p *Printer) SetAlign(a Align) (err error) {
+	return p.SetAlignContext(context.Background(), a)
+}
+
+func (p *Printer) SetAlignContext(ctx context.Context, a Align) (err error) {
+	if a < AlignBottomLeft || a > AlignTopRight {
+		return fmt.Errorf("fp: invalid alignment %d", a)
+	}
+
+	_, err = p.ExecContext(ctx, fmt.Sprintf("ALIGN %d", a))
+	return
+}
+
+// INVIMAGE / NORIMAGE
+// text and images printed while on are printed white on black within their
+// own field; it does not invert what is already on the canvas
+func (p *Printer) SetInverse(on bool) (err error) {
+	return p.SetInverseContext(context.Background(), on)
+}
+
+func (p *Printer) SetInverseContext(ctx context.Context, on bool) (err error) {
+	_, err = p.ExecContext(ctx, T(on, "II", "NI"))
+	return
+}
+
+// PRLINE <length>,<thickness>
+// draws a line along the current direction starting at the print position
+func (p *Printer) Line(length, thickness int) (err error) {
+	return p.LineContext(context.Background(), length, thickness)
+}
+
+func (p *Printer) LineContext(ctx context.Context, length, thickness int) (err error) {
+	if length <= 0 || thickness <= 0 {
+		return fmt.Errorf("fp: invalid line %dx%d", length, thickness)
+	}
+
+	_, err = p.ExecContext(ctx, prline(length, thickness))
+	return
+}
+
+// PRBOX <height>,<width>,<thickness>
+func (p *Printer) Box(width, height, thickness int) (err error) {
+	return p.RoundBoxContext(context.Background(), width, height, thickness, 0)
+}
+
+func (p *Printer) BoxContext(ctx context.Context, width, height, thickness int) (err error) {
+	return p.RoundBoxContext(ctx, width, height, thickness, 0)
+}
+
+// PRBOX <height>,<width>,<thickness>,<radius>
+func (p *Printer) RoundBox(width, height, thickness, radius int) (err error) {
+	return p.RoundBoxContext(context.Background(), width, height, thickness, radius)
+}
+
+func (p *Printer) RoundBoxContext(ctx context.Context, width, height, thickness, radius int) (err error) {
+	if width <= 0 || height <= 0 || thickness <= 0 || radius < 0 {
+		return fmt.Errorf("fp: invalid box %dx%d thickness %d radius %d",
+			width, height, thickness, radius)
+	}
+
+	_, err = p.ExecContext(ctx, prbox(width, height, thickness, radius))
+	return
+}
+
+// FillBox draws a solid black box, use SetInverse to print on top of it.
+// Fingerprint has no way to invert an arbitrary region of the canvas: fields
+// are ORed onto it, so a box drawn over existing fields hides them. Draw the
+// box first and print the fields inside it inverted.
+func (p *Printer) FillBox(width, height int) (err error) {
+	return p.FillBoxContext(context.Background(), width, height)
+}
+
+func (p *Printer) FillBoxContext(ctx context.Context, width, height int) (err error) {
+	return p.RoundBoxContext(ctx, width, height, fillThickness(width, height), 0)
+}
+
+// a box with lines this thick has no hole left
+func fillThickness(width, height int) int {
+	return (min(width, height) + 1) / 2
+}
+
+func prline(length, thickness int) string {
+	return fmt.Sprintf("PRLINE %d,%d", length, thickness)
+}
+
+func prbox(width, height, thickness, radius int) string {
+	if radius > 0 {
+		return fmt.Sprintf("PRBOX %d,%d,%d,%d", height, width, thickness, radius)
+	}
+
+	return fmt.Sprintf("PRBOX %d,%d,%d", height, width, thickness)
+}
@@ -6,11 +6,8 @@ import (
 
 	// image stuffs
 	"github.com/makeworld-the-better-one/dither/v2"
-	"github.com/nfnt/resize"
 	"github.com/samuel/go-pcx/pcx"
 	"image"
-	"image/color"
-	"image/draw"
 	_ "image/jpeg"
 	_ "image/png"
 
@@ -33,7 +30,12 @@ func (p *Printer) DirectPRBUF(d []byte) (err error) {
 
 // borked, uploads PCX data, printer no accept as image :(
 func (p *Printer) LoadImage(name string, i image.Image) (err error) {
-	d, err := DefaultConverter.Convert(i)
+	conv := *DefaultConverter
+	if p.Caps != nil {
+		conv.MaxSize = p.Caps.LabelSize(conv.MaxSize)
+	}
+
+	d, err := conv.Convert(i)
 	if err != nil {
 		return
 	}
@@ -91,9 +93,14 @@ const (
 
 type ImageConverter struct {
 	Dither        bool
-	MapColorspace bool // only works when dither is not set
+	Ditherer      *dither.Ditherer // Bayer 8x8 if nil, see DitherFromString
+	MapColorspace bool             // unused, images are always black and white
 
 	Resize Resize
+
+	// images are scaled down to fit, 807x1214 if zero;
+	// see Capabilities.LabelSize
+	MaxSize image.Point
 }
 
 var DefaultConverter = &ImageConverter{
@@ -102,88 +109,44 @@ var DefaultConverter = &ImageConverter{
 	Resize: ResizeOff,
 }
 
-// converts image i to a PCX encoded image
-func (conv *ImageConverter) Convert(i image.Image) (b []byte, err error) {
-	// try to cast image to *image.RGBA
-	rgba, ok := i.(*image.RGBA)
-	if !ok || rgba == nil { // convert to *image.RGBA
-		// fill blank with white
-		rgba = image.NewRGBA(i.Bounds())
-
-		// draw image
-		draw.Draw(rgba, rgba.Bounds(), i, image.Point{}, draw.Over)
+// Rasterizer returns the Rasterizer used by Convert: images are placed top
+// left on a MaxSize label, scaled down to fit (or up with ResizeFit) and
+// dithered, or thresholded at half brightness
+func (conv *ImageConverter) Rasterizer() *Rasterizer {
+	r := &Rasterizer{
+		LabelSize: image.Pt(orDefault(conv.MaxSize.X, 807), orDefault(conv.MaxSize.Y, 1214)),
+		Fit:       FitShrink,
 	}
 
-	// fill background with white
-	draw.DrawMask(rgba,
-		rgba.Bounds(),
-		rgba,
-		image.Point{},
-		&image.Uniform{color.Transparent},
-		image.Point{},
-		draw.Over)
-
-	w, h := uint(rgba.Bounds().Dx()), uint(rgba.Bounds().Dy())
-	// Calculate the scaling factors for width and height
-
-	var scale float64
-
-	const (
-		maxWidth  = 807
-		maxHeight = 1214
-	)
-
-	if w > maxWidth {
-		scale = float64(807) / float64(w)
-
-		w = uint(float64(w) * scale)
-		h = uint(float64(h) * scale)
-	} else if h > maxHeight {
-		scale = float64(maxHeight) / float64(h)
-
-		w = uint(float64(w) * scale)
-		h = uint(float64(h) * scale)
-	} else {
-		w = uint(float64(w) * scale)
-		h = uint(float64(h) * scale)
+	if conv.Resize == ResizeFit {
+		r.Fit = FitContain
 	}
 
-	log.Printf("resizing")
-	img := resize.Resize(w, h, rgba, resize.Bicubic)
-
-	// dither B/W:
 	if conv.Dither {
-		dit := dither.NewDitherer([]color.Color{color.White, color.Black})
-		dit.Mapper = dither.Bayer(8, 8, 1.0)
-		img = dit.Dither(img)
-	} else if conv.MapColorspace {
-
-		// B&W ify
-		for y := img.Bounds().Min.Y; y < rgba.Bounds().Max.Y; y++ {
-			for x := img.Bounds().Min.X; x < rgba.Bounds().Max.X; x++ {
-				// Get the color of the pixel in the original image
-				originalColor := rgba.At(x, y)
-
-				// Convert the color to the desired color space
-				newColor := prbuf.BWModel.Convert(originalColor)
-
-				// Set the color of the corresponding pixel in the new image
-				rgba.Set(x, y, newColor)
-			}
+		r.Dither = conv.Ditherer
+		if r.Dither == nil {
+			r.Dither, _ = DitherFromString("bayer8")
 		}
 	}
 
+	return r
+}
+
+// converts image i to a black and white PCX encoded image
+func (conv *ImageConverter) Convert(i image.Image) (b []byte, err error) {
+	img, err := conv.Rasterizer().Rasterize(i)
+	if err != nil {
+		return
+	}
+
 	// encode pcx
 	pcxb := new(bytes.Buffer)
 
-	err = pcx.Encode(pcxb, rgba)
+	err = pcx.Encode(pcxb, img)
 	if err != nil {
 		return
 	}
 
-	//debugging
-	//os.WriteFile("out.pcx", pcxb.Bytes(), 0755)
-
 	return pcxb.Bytes(), err
 }
 
@@ -191,7 +154,11 @@ func (conv *ImageConverter) Convert(i image.Image) (b []byte, err error) {
 func (p *Printer) DirectImage(i image.Image) (err error) {
 	buf := &bytes.Buffer{}
 
-	prbuf.Encode(i, buf)
+	err = prbuf.Encode(i, buf)
+	if err != nil {
+		return
+	}
+
 	d := buf.Bytes()
 
 	log.Printf("%d bytes of prbuf", len(d))
@@ -0,0 +1,507 @@
+package fp
+
+import (
+	// image stuffs
+	_ "github.com/rileys-trash-can/libfp/prbuf"
+	_ "golang.org/x/image/bmp"
+	"image"
+	_ "image/png"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Interpreter executes the layout subset of Fingerprint on a software canvas
+// to preview programs without wasting labels: PP, DIR, ALIGN, MAG, II, NI,
+// FONT, PRTXT, PRLINE, PRBOX, BARSET, BARFONT, PRBAR, PRBUF, PRIMAGE, CLL
+// and PF. Text and barcodes are approximated, see Label.Render.
+type Interpreter struct {
+	// images available to PRIMAGE by name
+	Images map[string]image.Image
+
+	canvas *canvas
+	labels []*image.Gray
+
+	barcode Barcode
+}
+
+// MaxPreviewFeeds is the most labels one PF may feed in a preview
+const MaxPreviewFeeds = 10000
+
+// NewInterpreter returns an interpreter with a canvas of size dots
+func NewInterpreter(size image.Point, dpi int) *Interpreter {
+	return &Interpreter{
+		Images: make(map[string]image.Image),
+		canvas: newCanvas(size, dpi),
+	}
+}
+
+// Run executes the program read from r line by line. Like on the printer a
+// failing line does not stop the program; all errors are returned joined,
+// prefixed by their line number.
+func (in *Interpreter) Run(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	var errs []error
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return errors.Join(append(errs, err)...)
+		}
+
+		if line != "" {
+			xerr := in.Exec(strings.TrimRight(line, "\r\n"), br)
+			if xerr != nil {
+				errs = append(errs, fmt.Errorf("line %d: %w", n, xerr))
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Exec executes one program line, binary data of PRBUF is read from r.
+// Statements after a failing one are not executed; ErrNotImplemented is
+// returned for statements the interpreter does not know.
+func (in *Interpreter) Exec(line string, r io.Reader) (err error) {
+	for _, stmt := range SplitStatements(line) {
+		err = in.statement(stmt, r)
+		if err != nil {
+			code := ECIllegalValue
+
+			var fperr *FingerprintError
+			if errors.As(err, &fperr) {
+				code = fperr.Code
+			}
+
+			return &FingerprintError{Code: code, Message: ErrorText(code), Command: stmt}
+		}
+	}
+
+	return
+}
+
+// Canvas returns a copy of the current canvas
+func (in *Interpreter) Canvas() *image.Gray {
+	return cloneGray(in.canvas.img)
+}
+
+// Labels returns the canvas of every label fed with PF so far, the copies
+// fed by one PF share their image
+func (in *Interpreter) Labels() []*image.Gray {
+	return append([]*image.Gray(nil), in.labels...)
+}
+
+// Reset clears the canvas, the printed labels and all settings
+func (in *Interpreter) Reset() {
+	in.canvas.clear()
+	in.canvas.reset()
+	in.labels = nil
+	in.barcode = Barcode{}
+}
+
+func (in *Interpreter) statement(stmt string, r io.Reader) (err error) {
+	c := in.canvas
+	name, args := splitCommand(stmt)
+
+	switch name {
+	case "", "REM":
+
+	case "PP", "PRPOS":
+		var n []int
+		n, err = intArgs(args, 2, 2)
+		if err != nil {
+			return
+		}
+
+		c.pos = image.Pt(n[0], n[1])
+
+	case "DIR":
+		var n []int
+		n, err = intArgs(args, 1, 1)
+		if err != nil {
+			return
+		}
+
+		if n[0] < int(DirLeftToRight) || n[0] > int(DirBottomToTop) {
+			return ErrIllegalValue
+		}
+
+		c.dir = Direction(n[0])
+
+	case "ALIGN", "AN":
+		var n []int
+		n, err = intArgs(args, 1, 1)
+		if err != nil {
+			return
+		}
+
+		if n[0] < int(AlignBottomLeft) || n[0] > int(AlignTopRight) {
+			return ErrIllegalValue
+		}
+
+		c.align = Align(n[0])
+
+	case "MAG":
+		var n []int
+		n, err = intArgs(args, 2, 2)
+		if err != nil {
+			return
+		}
+
+		if n[0] < 1 || n[0] > 4 || n[1] < 1 || n[1] > 4 {
+			return ErrIllegalValue
+		}
+
+		c.magx, c.magy = n[0], n[1]
+
+	case "II", "INVIMAGE":
+		c.inverse = true
+
+	case "NI", "NORIMAGE":
+		c.inverse = false
+
+	case "FONT", "FT":
+		parts := splitArgs(args)
+		if len(parts) < 1 || len(parts) > 3 {
+			return ErrSyntax
+		}
+
+		var font string
+		font, err = stringArg(parts[0])
+		if err != nil {
+			return
+		}
+
+		var n []int
+		n, err = intArgs(strings.Join(parts[1:], ","), 0, 2)
+		if err != nil {
+			return
+		}
+
+		if len(n) > 0 && (n[0] <= 0 || n[0]*c.dpi/72 > c.limit()) {
+			return ErrIllegalValue
+		}
+
+		if len(n) > 1 && (n[1] < 0 || n[1] > 45) {
+			return ErrIllegalValue
+		}
+
+		c.font = font
+		if len(n) > 0 {
+			c.size = n[0]
+		}
+
+		if len(n) > 1 {
+			c.slant = n[1]
+		}
+
+	case "PRTXT", "PT":
+		var s string
+		s, err = stringArg(args)
+		if err != nil {
+			return
+		}
+
+		c.text(s)
+
+	case "PRLINE", "PL":
+		var n []int
+		n, err = intArgs(args, 2, 2)
+		if err != nil {
+			return
+		}
+
+		if n[0] <= 0 || n[1] <= 0 || n[0] > c.limit() || n[1] > c.limit() {
+			return ErrIllegalValue
+		}
+
+		c.line(n[0], n[1])
+
+	case "PRBOX", "PX":
+		var n []int
+		n, err = intArgs(args, 3, 4)
+		if err != nil {
+			return
+		}
+
+		n = append(n, 0)
+		if n[0] <= 0 || n[1] <= 0 || n[2] <= 0 || n[3] < 0 ||
+			n[0] > c.limit() || n[1] > c.limit() || n[2] > c.limit() || n[3] > c.limit() {
+			return ErrIllegalValue
+		}
+
+		// height first
+		c.box(n[1], n[0], n[2], n[3])
+
+	case "BARSET":
+		parts := splitArgs(args)
+		if len(parts) < 1 {
+			return ErrSyntax
+		}
+
+		var typ string
+		typ, err = stringArg(parts[0])
+		if err != nil {
+			return
+		}
+
+		var n []int
+		n, err = intArgs(strings.Join(parts[1:], ","), 0, 5)
+		if err != nil {
+			return
+		}
+
+		for _, v := range n {
+			if v < 0 || v > c.limit() {
+				return ErrIllegalValue
+			}
+		}
+
+		n = append(n, 0, 0, 0, 0, 0)
+		in.barcode = Barcode{
+			Type:       Symbology(strings.ToUpper(typ)),
+			RatioLarge: n[0], RatioSmall: n[1],
+			Enlargement: n[2], Height: n[3], SecurityLevel: n[4],
+			HumanReadable: in.barcode.HumanReadable,
+		}
+
+	case "BARFONT", "BF":
+		// BARFONT ["<font>",<size>,...] ON|OFF
+		switch up := strings.ToUpper(args); {
+		case strings.HasSuffix(up, "OFF"):
+			in.barcode.HumanReadable = false
+
+		case strings.HasSuffix(up, "ON"):
+			in.barcode.HumanReadable = true
+		}
+
+	case "PRBAR", "PB":
+		b := in.barcode
+		b.Type = Symbology(T(b.Type == "", string(Code128), string(b.Type)))
+
+		b.Data, err = stringArg(args)
+		if err != nil {
+			return
+		}
+
+		c.barcode(&b)
+
+	case "PRBUF":
+		var n []int
+		n, err = intArgs(args, 1, 2)
+		if err != nil {
+			return
+		}
+
+		if n[0] < 0 || n[0] > c.maxPRBUF() {
+			return ErrIllegalValue
+		}
+
+		// the data directly follows the command line
+		data := make([]byte, n[0])
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return ErrIllegalValue
+		}
+
+		// images larger than the canvas would only be cut off
+		var conf image.Config
+		conf, _, err = image.DecodeConfig(bytes.NewReader(data))
+		if err != nil || conf.Width > c.img.Rect.Dx() || conf.Height > c.img.Rect.Dy() {
+			return ErrIllegalValue
+		}
+
+		var img image.Image
+		img, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return ErrIllegalValue
+		}
+
+		c.bitmap(img)
+
+	case "PRIMAGE", "PM":
+		var name string
+		name, err = stringArg(args)
+		if err != nil {
+			return
+		}
+
+		img, ok := in.Images[name]
+		if !ok {
+			return ErrImageNotFound
+		}
+
+		c.bitmap(img)
+
+	case "CLL":
+		c.clear()
+
+	case "PF", "PRINTFEED":
+		var n []int
+		n, err = intArgs(args, 0, 1)
+		if err != nil {
+			return
+		}
+
+		count := 1
+		if len(n) > 0 {
+			count = n[0]
+		}
+
+		if count < 0 || count > MaxPreviewFeeds {
+			return ErrIllegalValue
+		}
+
+		// the canvas is kept, like the printers image buffer, until CLL;
+		// copies share one image
+		label := cloneGray(c.img)
+		for i := 0; i < count; i++ {
+			in.labels = append(in.labels, label)
+		}
+
+	default:
+		return ErrNotImplemented
+	}
+
+	return
+}
+
+// SplitStatements splits a program line on colons outside of quotes
+func SplitStatements(line string) (stmts []string) {
+	var quoted bool
+	var start int
+
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+
+		case '"':
+			quoted = !quoted
+
+		case ':':
+			if !quoted {
+				stmts = append(stmts, strings.TrimSpace(line[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	stmts = append(stmts, strings.TrimSpace(line[start:]))
+
+	return
+}
+
+func splitCommand(stmt string) (name, args string) {
+	name, args, _ = strings.Cut(stmt, " ")
+
+	return strings.ToUpper(name), strings.TrimSpace(args)
+}
+
+// splits on commas outside of quotes
+func splitArgs(args string) (parts []string) {
+	if strings.TrimSpace(args) == "" {
+		return nil
+	}
+
+	var quoted bool
+	var start int
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case '\\':
+			i++
+
+		case '"':
+			quoted = !quoted
+
+		case ',':
+			if !quoted {
+				parts = append(parts, strings.TrimSpace(args[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, strings.TrimSpace(args[start:]))
+}
+
+// lo to hi integer literals separated by commas
+func intArgs(args string, lo, hi int) (n []int, err error) {
+	parts := splitArgs(args)
+	if len(parts) < lo || len(parts) > hi {
+		return nil, ErrSyntax
+	}
+
+	n = make([]int, len(parts))
+	for i, p := range parts {
+		n[i], err = strconv.Atoi(p)
+		if err != nil {
+			return nil, ErrSyntax
+		}
+	}
+
+	return
+}
+
+// string literals, optionally concatenated with ';' or '+'
+func stringArg(arg string) (s string, err error) {
+	arg = strings.TrimSpace(arg)
+
+	for {
+		if len(arg) < 2 || arg[0] != '"' {
+			// variables and functions are not supported
+			return "", T(arg == "", ErrSyntax, ErrNotImplemented)
+		}
+
+		i := 1
+		for ; i < len(arg) && arg[i] != '"'; i++ {
+			if arg[i] == '\\' {
+				i++
+			}
+		}
+
+		if i >= len(arg) {
+			return "", ErrSyntax
+		}
+
+		s += Unquote(arg[:i+1])
+
+		arg = strings.TrimSpace(arg[i+1:])
+		if arg == "" {
+			return
+		}
+
+		if arg[0] != ';' && arg[0] != '+' {
+			return "", ErrSyntax
+		}
+
+		arg = strings.TrimSpace(arg[1:])
+	}
+}
+
+// Unquote reverses Quote, s is returned unchanged if not quoted
+func Unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\\\"", "\""), "\\n", "\n")
+}
+
+func cloneGray(src *image.Gray) *image.Gray {
+	dst := image.NewGray(src.Bounds())
+	copy(dst.Pix, src.Pix)
+
+	return dst
+}
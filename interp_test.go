@@ -0,0 +1,62 @@
+package fp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"strconv"
+	"testing"
+
+	"github.com/rileys-trash-can/libfp/prbuf"
+)
+
+func TestInterpreterBounds(t *testing.T) {
+	size := image.Pt(400, 200)
+
+	prbufOf := func(w, h int) string {
+		var buf bytes.Buffer
+		err := prbuf.Encode(prbuf.NewBitmap(image.Rect(0, 0, w, h)), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return "PRBUF " + strconv.Itoa(buf.Len()) + "\n" + buf.String()
+	}
+
+	tests := []struct {
+		name    string
+		program string
+		ok      bool
+	}{
+		{"line", "PRLINE 100,10", true},
+		{"line negative", "PRLINE -1,10", false},
+		{"line too long", "PRLINE 100000000,100000000", false},
+		{"box", "PRBOX 100,100,1", true},
+		{"box too large", "PRBOX 100000,100000,1", false},
+		{"box thick", "PRBOX 100,100,100000", false},
+		{"font", `FONT "Swiss 721 BT",12`, true},
+		{"font too large", `FONT "Swiss 721 BT",100000`, false},
+		{"font slant", `FONT "Swiss 721 BT",12,100`, false},
+		{"barset too high", `BARSET "CODE128",2,1,3,100000`, false},
+		{"prbuf", prbufOf(10, 10), true},
+		{"prbuf negative", "PRBUF -1", false},
+		{"prbuf too long", "PRBUF 100000000", false},
+		{"prbuf larger than canvas", prbufOf(500, 10), false},
+		{"pf", "PF 3", true},
+		{"pf negative", "PF -1", false},
+		{"pf too many", "PF 1000000", false},
+	}
+
+	for _, tt := range tests {
+		in := NewInterpreter(size, 203)
+		err := in.Run(bytes.NewBufferString(tt.program))
+
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		if !tt.ok && !errors.Is(err, ErrIllegalValue) {
+			t.Errorf("%s: got %v, want ErrIllegalValue", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package fp
+
+import (
+	"github.com/rileys-trash-can/libfp/prbuf"
+
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// rows per PRBUF of an ImageField; large images crash some printers
+const labelChunkHeight = 100
+
+// Label is a label document. It can be validated against its size,
+// rendered for preview and compiled to a Fingerprint program that is
+// printed in one batch.
+//
+// Positions are in dots in the printers coordinate system, the origin is in
+// the lower left corner of the label and y grows upwards.
+type Label struct {
+	Size image.Point // printable area in dots
+	DPI  int         // used for previews; DefaultDPI if zero
+
+	Fields []Field
+}
+
+// Field is an element of a Label; one of *TextField, *ImageField,
+// *BarcodeField, *LineField and *BoxField
+type Field interface {
+	validate() error
+
+	// area covered in printer coordinates; text and barcodes are measured
+	// like the preview renders them, which approximates the printers fonts
+	bounds(c *canvas) image.Rectangle
+
+	draw(c *canvas)
+	compile(pr *program) error
+}
+
+type TextField struct {
+	Pos   image.Point
+	Text  string
+	Style TextStyle
+}
+
+// ImageField prints Image, pixels prbuf.IsDark reports are printed black
+type ImageField struct {
+	Pos   image.Point
+	Image image.Image
+	Align Align // AlignBottomLeft if zero
+}
+
+type BarcodeField struct {
+	Pos       image.Point
+	Barcode   Barcode
+	Direction Direction // DirLeftToRight if zero
+	Align     Align     // AlignBottomLeft if zero
+}
+
+type LineField struct {
+	Pos       image.Point
+	Length    int
+	Thickness int
+	Direction Direction // DirLeftToRight if zero
+	Align     Align     // AlignBottomLeft if zero
+}
+
+type BoxField struct {
+	Pos       image.Point
+	Width     int
+	Height    int
+	Thickness int  // line thickness, ignored if Fill
+	Radius    int  // of rounded corners
+	Fill      bool // solid box
+
+	Direction Direction // DirLeftToRight if zero
+	Align     Align     // AlignBottomLeft if zero
+}
+
+// Validate checks every field and that it fits on the label; the size of
+// text and barcodes is estimated like Render draws them
+func (l *Label) Validate() error {
+	if l.Size.X <= 0 || l.Size.Y <= 0 {
+		return fmt.Errorf("fp: invalid label size %v", l.Size)
+	}
+
+	label := image.Rectangle{Max: l.Size}
+	c := &canvas{dpi: T(l.DPI > 0, l.DPI, DefaultDPI)}
+
+	for i, f := range l.Fields {
+		if f == nil {
+			return fmt.Errorf("fp: label field %d: nil field", i)
+		}
+
+		err := f.validate()
+		if err != nil {
+			return fmt.Errorf("fp: label field %d: %w", i, err)
+		}
+
+		c.reset()
+		r := f.bounds(c)
+		if !r.In(label) {
+			return fmt.Errorf("fp: label field %d at %v: %w", i, r, ErrFieldOutOfLabel)
+		}
+	}
+
+	return nil
+}
+
+// Render draws a preview of l; fonts and barcodes are approximated
+func (l *Label) Render() *image.Gray {
+	c := newCanvas(l.Size, l.DPI)
+
+	for _, f := range l.Fields {
+		c.reset()
+		f.draw(c)
+	}
+
+	return c.img
+}
+
+// WriteProgram writes l as Fingerprint program to w. The program starts by
+// clearing the canvas and does not feed the label; image fields are sent as
+// PRBUF followed by their binary data.
+func (l *Label) WriteProgram(w io.Writer) (err error) {
+	pr, err := l.compile()
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(pr.buf.Bytes())
+	return
+}
+
+func (l *Label) compile() (pr *program, err error) {
+	err = l.Validate()
+	if err != nil {
+		return
+	}
+
+	pr = &program{}
+	pr.line("CLL")
+
+	for i, f := range l.Fields {
+		err = f.compile(pr)
+		if err != nil {
+			return nil, fmt.Errorf("fp: label field %d: %w", i, err)
+		}
+	}
+
+	return
+}
+
+// PrintLabel sends l and prints copies of it in one batch; all commands are
+// sent before the responses are read. The first error the printer reported
+// is returned.
+func (p *Printer) PrintLabel(l *Label, copies uint) (err error) {
+	return p.PrintLabelContext(context.Background(), l, copies)
+}
+
+func (p *Printer) PrintLabelContext(ctx context.Context, l *Label, copies uint) (err error) {
+	pr, err := l.compile()
+	if err != nil {
+		return
+	}
+
+	if copies > 0 {
+		pr.line(fmt.Sprintf("PF %d", copies))
+	}
+
+	return p.do(ctx, func() error {
+		return p.batch(pr)
+	})
+}
+
+// writes pr while reading one response per line
+func (p *Printer) batch(pr *program) (err error) {
+	werr := make(chan error, 1)
+	go func() {
+		werr <- p.writeAll(pr.buf.Bytes())
+	}()
+
+	for i := 0; i < pr.lines; i++ {
+		_, rerr := p.readResponse()
+		if rerr == nil {
+			continue
+		}
+
+		// connection is broken, the writer must be done before the next
+		// round-trip; it fails as well or is interrupted by the deadline
+		var fperr *FingerprintError
+		if !errors.As(rerr, &fperr) {
+			<-werr
+			return rerr
+		}
+
+		if err == nil {
+			err = rerr
+		}
+	}
+
+	if e := <-werr; e != nil && err == nil {
+		err = e
+	}
+
+	return
+}
+
+type program struct {
+	buf   bytes.Buffer
+	lines int
+}
+
+func (pr *program) line(s string) {
+	pr.buf.Write(EncodeMsg(s))
+	pr.lines++
+}
+
+func (pr *program) payload(d []byte) {
+	pr.buf.Write(d)
+}
+
+// PP <x>,<y>:DIR <d>:ALIGN <a>:NI
+func fieldPrefix(pos image.Point, d Direction, a Align) string {
+	return fmt.Sprintf("PP %d,%d:DIR %d:ALIGN %d:NI", pos.X, pos.Y,
+		orDefault(int(d), int(DirLeftToRight)), orDefault(int(a), int(AlignBottomLeft)))
+}
+
+func (f *TextField) validate() error {
+	return f.Style.Validate()
+}
+
+func (f *TextField) bounds(c *canvas) image.Rectangle {
+	c.style(&f.Style)
+	c.pos = f.Pos
+
+	s := c.textMask(f.Text).Bounds().Size()
+	return c.fieldRect(s.X, s.Y)
+}
+
+func (f *TextField) draw(c *canvas) {
+	c.style(&f.Style)
+	c.pos = f.Pos
+	c.text(f.Text)
+}
+
+func (f *TextField) compile(pr *program) error {
+	pr.line(fmt.Sprintf("PP %d,%d:%s:PRTXT %s",
+		f.Pos.X, f.Pos.Y, f.Style.statement(), Quote(f.Text)))
+
+	return nil
+}
+
+func (f *ImageField) validate() error {
+	if f.Image == nil {
+		return errors.New("no image")
+	}
+
+	if f.Align < 0 || f.Align > AlignTopRight {
+		return fmt.Errorf("invalid alignment %d", f.Align)
+	}
+
+	return nil
+}
+
+func (f *ImageField) bounds(c *canvas) image.Rectangle {
+	c.pos = f.Pos
+	c.align = Align(orDefault(int(f.Align), int(AlignBottomLeft)))
+
+	size := f.Image.Bounds().Size()
+	return c.fieldRect(size.X, size.Y)
+}
+
+func (f *ImageField) draw(c *canvas) {
+	c.pos = f.Pos
+	c.align = Align(orDefault(int(f.Align), int(AlignBottomLeft)))
+	c.bitmap(f.Image)
+}
+
+// sent in horizontal strips, each placed by its lower left corner
+func (f *ImageField) compile(pr *program) (err error) {
+	b := f.Image.Bounds()
+	origin := f.bounds(&canvas{dir: DirLeftToRight}).Min
+
+	for y := 0; y < b.Dy(); y += labelChunkHeight {
+		h := min(labelChunkHeight, b.Dy()-y)
+		strip := crop(f.Image, image.Rect(b.Min.X, b.Min.Y+y, b.Max.X, b.Min.Y+y+h))
+
+		buf := &bytes.Buffer{}
+		err = prbuf.Encode(strip, buf)
+		if err != nil {
+			return
+		}
+
+		// image rows grow downwards, printer coordinates upwards
+		pr.line(fieldPrefix(image.Pt(origin.X, origin.Y+b.Dy()-y-h), DirLeftToRight, AlignBottomLeft))
+		pr.line(fmt.Sprintf("PRBUF %d", buf.Len()))
+		pr.payload(buf.Bytes())
+	}
+
+	return
+}
+
+func (f *BarcodeField) validate() error {
+	if f.Direction < 0 || f.Direction > DirBottomToTop {
+		return fmt.Errorf("invalid direction %d", f.Direction)
+	}
+
+	if f.Align < 0 || f.Align > AlignTopRight {
+		return fmt.Errorf("invalid alignment %d", f.Align)
+	}
+
+	return f.Barcode.Validate()
+}
+
+func (f *BarcodeField) bounds(c *canvas) image.Rectangle {
+	f.setup(c)
+
+	s := c.barcodeMask(&f.Barcode).Bounds().Size()
+	return c.fieldRect(s.X, s.Y)
+}
+
+func (f *BarcodeField) setup(c *canvas) {
+	c.pos = f.Pos
+	c.dir = Direction(orDefault(int(f.Direction), int(DirLeftToRight)))
+	c.align = Align(orDefault(int(f.Align), int(AlignBottomLeft)))
+}
+
+func (f *BarcodeField) draw(c *canvas) {
+	f.setup(c)
+	c.barcode(&f.Barcode)
+}
+
+func (f *BarcodeField) compile(pr *program) error {
+	pr.line(fieldPrefix(f.Pos, f.Direction, f.Align) + ":" + f.Barcode.statement())
+
+	return nil
+}
+
+func (f *LineField) validate() error {
+	if f.Length <= 0 || f.Thickness <= 0 {
+		return fmt.Errorf("invalid line %dx%d", f.Length, f.Thickness)
+	}
+
+	return validDirAlign(f.Direction, f.Align)
+}
+
+func (f *LineField) bounds(c *canvas) image.Rectangle {
+	f.setup(c)
+	return c.fieldRect(f.Length, f.Thickness)
+}
+
+func (f *LineField) draw(c *canvas) {
+	f.setup(c)
+	c.line(f.Length, f.Thickness)
+}
+
+func (f *LineField) setup(c *canvas) {
+	c.pos = f.Pos
+	c.dir = Direction(orDefault(int(f.Direction), int(DirLeftToRight)))
+	c.align = Align(orDefault(int(f.Align), int(AlignBottomLeft)))
+}
+
+func (f *LineField) compile(pr *program) error {
+	pr.line(fieldPrefix(f.Pos, f.Direction, f.Align) + ":" + prline(f.Length, f.Thickness))
+
+	return nil
+}
+
+func (f *BoxField) validate() error {
+	if f.Width <= 0 || f.Height <= 0 || f.Radius < 0 || (!f.Fill && f.Thickness <= 0) {
+		return fmt.Errorf("invalid box %dx%d thickness %d radius %d",
+			f.Width, f.Height, f.Thickness, f.Radius)
+	}
+
+	return validDirAlign(f.Direction, f.Align)
+}
+
+func (f *BoxField) bounds(c *canvas) image.Rectangle {
+	f.setup(c)
+	return c.fieldRect(f.Width, f.Height)
+}
+
+func (f *BoxField) draw(c *canvas) {
+	f.setup(c)
+	c.box(f.Width, f.Height, f.thickness(), f.Radius)
+}
+
+func (f *BoxField) setup(c *canvas) {
+	c.pos = f.Pos
+	c.dir = Direction(orDefault(int(f.Direction), int(DirLeftToRight)))
+	c.align = Align(orDefault(int(f.Align), int(AlignBottomLeft)))
+}
+
+func (f *BoxField) thickness() int {
+	return T(f.Fill, fillThickness(f.Width, f.Height), f.Thickness)
+}
+
+func (f *BoxField) compile(pr *program) error {
+	pr.line(fieldPrefix(f.Pos, f.Direction, f.Align) + ":" +
+		prbox(f.Width, f.Height, f.thickness(), f.Radius))
+
+	return nil
+}
+
+func validDirAlign(d Direction, a Align) error {
+	if d < 0 || d > DirBottomToTop {
+		return fmt.Errorf("invalid direction %d", d)
+	}
+
+	if a < 0 || a > AlignTopRight {
+		return fmt.Errorf("invalid alignment %d", a)
+	}
+
+	return nil
+}
+
+func crop(img image.Image, r image.Rectangle) image.Image {
+	if s, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+
+	dst := image.NewRGBA(r)
+	draw.Draw(dst, r, img, r.Min, draw.Src)
+
+	return dst
+}
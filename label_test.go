@@ -0,0 +1,40 @@
+package fp
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestValidateBounds(t *testing.T) {
+	size := image.Pt(400, 200)
+
+	tests := []struct {
+		name  string
+		field Field
+		fits  bool
+	}{
+		{"text", &TextField{Pos: image.Pt(10, 10), Text: "short"}, true},
+		{"text overflowing right", &TextField{Pos: image.Pt(300, 10), Text: "this text is far too long"}, false},
+		{"text overflowing top", &TextField{Pos: image.Pt(10, 180), Text: "tall", Style: TextStyle{Size: 24}}, false},
+		{"text rotated", &TextField{Pos: image.Pt(390, 100), Text: "upwards", Style: TextStyle{Direction: DirBottomToTop}}, false},
+
+		{"barcode", &BarcodeField{Pos: image.Pt(10, 10), Barcode: Barcode{Type: Code128, Data: "123", Height: 50}}, true},
+		{"barcode too high", &BarcodeField{Pos: image.Pt(10, 10), Barcode: Barcode{Type: Code128, Data: "123", Height: 250}}, false},
+		{"barcode too long", &BarcodeField{Pos: image.Pt(10, 10), Barcode: Barcode{Type: Code128, Data: "123456789012345678901234567890", Height: 50}}, false},
+		{"barcode centered", &BarcodeField{Pos: image.Pt(200, 10), Align: AlignBottomCenter, Barcode: Barcode{Type: Code128, Data: "123", Height: 50}}, true},
+	}
+
+	for _, tt := range tests {
+		l := &Label{Size: size, Fields: []Field{tt.field}}
+		err := l.Validate()
+
+		if tt.fits && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		if !tt.fits && !errors.Is(err, ErrFieldOutOfLabel) {
+			t.Errorf("%s: got %v, want ErrFieldOutOfLabel", tt.name, err)
+		}
+	}
+}
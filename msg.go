@@ -3,6 +3,7 @@ package fp
 import (
 	"bufio"
 	"bytes"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -35,3 +36,8 @@ func UTF8encode(s string) []byte {
 func EncodeMsg(msg string) []byte {
 	return UTF8encode(msg + CRLF)
 }
+
+// Quote returns s as a Fingerprint string literal
+func Quote(s string) string {
+	return "\"" + strings.ReplaceAll(strings.ReplaceAll(s, "\n", "\\n"), "\"", "\\\"") + "\""
+}
@@ -0,0 +1,103 @@
+package prbuf
+
+import (
+	// image stuffs
+	"image"
+	"image/color"
+)
+
+// Bitmap is a packed black and white image, 8 pixels per byte with the
+// leftmost pixel in the most significant bit; set bits are black
+type Bitmap struct {
+	Pix    []uint8
+	Stride int // bytes per row
+	Rect   image.Rectangle
+}
+
+// NewBitmap returns a white bitmap of size r
+func NewBitmap(r image.Rectangle) *Bitmap {
+	stride := (r.Dx() + 7) / 8
+
+	return &Bitmap{
+		Pix:    make([]uint8, stride*r.Dy()),
+		Stride: stride,
+		Rect:   r,
+	}
+}
+
+func (b *Bitmap) ColorModel() color.Model {
+	return BWModel
+}
+
+func (b *Bitmap) Bounds() image.Rectangle {
+	return b.Rect
+}
+
+func (b *Bitmap) Opaque() bool {
+	return true
+}
+
+// PixOffset returns the index of the byte and the mask of the bit of (x, y)
+func (b *Bitmap) PixOffset(x, y int) (i int, mask uint8) {
+	x, y = x-b.Rect.Min.X, y-b.Rect.Min.Y
+
+	return y*b.Stride + x/8, 0x80 >> (x % 8)
+}
+
+func (b *Bitmap) At(x, y int) color.Color {
+	if b.BlackAt(x, y) {
+		return Black
+	}
+
+	return White
+}
+
+// BlackAt reports whether (x, y) is black, outside of the bounds is white
+func (b *Bitmap) BlackAt(x, y int) bool {
+	if !(image.Point{x, y}.In(b.Rect)) {
+		return false
+	}
+
+	i, mask := b.PixOffset(x, y)
+	return b.Pix[i]&mask != 0
+}
+
+// Set sets (x, y) to black if IsDark(c)
+func (b *Bitmap) Set(x, y int, c color.Color) {
+	b.SetBlack(x, y, IsDark(c))
+}
+
+func (b *Bitmap) SetBlack(x, y int, black bool) {
+	if !(image.Point{x, y}.In(b.Rect)) {
+		return
+	}
+
+	i, mask := b.PixOffset(x, y)
+	if black {
+		b.Pix[i] |= mask
+	} else {
+		b.Pix[i] &^= mask
+	}
+}
+
+// setRun blackens n pixels from (x, y) on, within the row
+func (b *Bitmap) setRun(x, y, n int) {
+	i, mask := b.PixOffset(x, y)
+
+	for ; n > 0; n-- {
+		// whole bytes
+		if mask == 0x80 && n >= 8 {
+			b.Pix[i] = 0xff
+			i++
+			n -= 7
+			continue
+		}
+
+		b.Pix[i] |= mask
+		mask >>= 1
+		if mask == 0 {
+			mask = 0x80
+			i++
+		}
+	}
+}
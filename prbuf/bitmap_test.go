@@ -0,0 +1,64 @@
+package prbuf
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// setRun has to match setting the pixels one by one, runs of 8 and more
+// starting on a byte take the whole byte path
+func TestSetRun(t *testing.T) {
+	const width = 45
+
+	for x := 0; x < width; x++ {
+		for n := 0; x+n <= width; n++ {
+			r := image.Rect(0, 0, width, 3)
+			got, want := NewBitmap(r), NewBitmap(r)
+
+			got.setRun(x, 1, n)
+			for i := x; i < x+n; i++ {
+				want.SetBlack(i, 1, true)
+			}
+
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Fatalf("setRun(%d, 1, %d): %08b, want %08b", x, n, got.Pix, want.Pix)
+			}
+		}
+	}
+}
+
+func TestPixOffset(t *testing.T) {
+	b := NewBitmap(image.Rect(-3, 5, 20, 9))
+
+	tests := []struct {
+		x, y int
+		i    int
+		mask uint8
+	}{
+		{-3, 5, 0, 0x80},
+		{4, 5, 0, 0x01},
+		{5, 5, 1, 0x80},
+		{-1, 6, b.Stride, 0x20},
+		{19, 8, 3*b.Stride + 2, 0x02},
+	}
+
+	for _, tt := range tests {
+		i, mask := b.PixOffset(tt.x, tt.y)
+		if i != tt.i || mask != tt.mask {
+			t.Errorf("PixOffset(%d, %d) = %d, %#02x, want %d, %#02x", tt.x, tt.y, i, mask, tt.i, tt.mask)
+		}
+	}
+
+	b.SetBlack(-3, 5, true)
+	b.SetBlack(19, 8, true)
+	b.SetBlack(20, 8, true) // outside
+
+	if !b.BlackAt(-3, 5) || !b.BlackAt(19, 8) || b.BlackAt(-2, 5) || b.BlackAt(20, 8) {
+		t.Errorf("pixels at the corners are wrong: %08b", b.Pix)
+	}
+
+	if b.At(-3, 5) != Black || b.At(0, 0) != White {
+		t.Error("At does not match BlackAt")
+	}
+}
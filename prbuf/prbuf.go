@@ -7,7 +7,6 @@ import (
 	"bufio"
 	"image"
 	"image/color"
-	"image/draw"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
@@ -21,20 +20,32 @@ var (
 	Black = &BW{Black: true}
 	White = &BW{Black: false}
 
+	// BWModel maps colors IsDark reports to Black, the others to White
 	BWModel = color.ModelFunc(bwModel)
 )
 
 func bwModel(c color.Color) color.Color {
-	r, g, b, _ := c.RGBA()
-
-	// moa than 50% black or sth
-	if ((uint64(r) + uint64(g) + uint64(b)) / 3) > (65535 / 2) {
+	if IsDark(c) {
 		return Black
-	} else {
-		return White
 	}
+
+	return White
+}
+
+// Threshold is the brightness, the mean of r, g and b from 0 to 0xffff, up
+// to which colors are printed black by Encode, BWModel, Bitmap.Set and the
+// preview and rasterizer of fp
+const Threshold = 0xffff / 2
+
+// IsDark reports whether c is at most Threshold bright
+func IsDark(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+
+	return ((uint64(r) + uint64(g) + uint64(b)) / 3) <= Threshold
 }
 
+// Deprecated: IsBlack reports colors more than 2/3 bright, which are
+// printed white; use IsDark
 func IsBlack(c color.Color) bool {
 	r, g, b, _ := c.RGBA()
 
@@ -45,8 +56,12 @@ func IsBlack(c color.Color) bool {
 // for RLE of PRBUF
 const MAX_LEN = 127
 
+// of width and height
+const MAX_SIZE = 0xffff
+
 var (
 	ErrInvalidMagicBytes = errors.New("Magic bytes invalid")
+	ErrInvalidSize       = errors.New("Image size invalid")
 )
 
 type ErrPRBUFDecode struct {
@@ -74,16 +89,6 @@ func readU16(r io.Reader) (i uint16, err error) {
 	return binary.BigEndian.Uint16(buf), err
 }
 
-func readU8(r io.Reader) (i uint8, err error) {
-	buf := make([]byte, 1)
-	_, err = io.ReadFull(r, buf)
-	if err != nil {
-		return
-	}
-
-	return uint8(buf[0]), err
-}
-
 type BW struct {
 	Black bool
 }
@@ -139,16 +144,29 @@ func DecodeConfig(r io.Reader) (c image.Config, err error) {
 	return
 }
 
-func Decode(r io.Reader) (img image.Image, err error) { // (img *BWImage, err error) {
+// Decode returns a *Bitmap
+func Decode(r io.Reader) (img image.Image, err error) {
 	// check magic bytes
 	conf, err := DecodeConfig(r)
+	if err != nil {
+		return
+	}
 
-	iimg := draw.Image(image.NewRGBA(image.Rect(0, 0, conf.Width, conf.Height)))
-	img = iimg
-	//img = newBW(int(width), int(height))
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	bm := NewBitmap(image.Rect(0, 0, conf.Width, conf.Height))
+	img = bm
+
+	// rows without pixels hold no runs
+	if conf.Width == 0 {
+		return
+	}
 
 	var yindex, xindex int
-	var color *BW = White
+	var black bool
 	var b uint8
 
 	for {
@@ -159,113 +177,162 @@ func Decode(r io.Reader) (img image.Image, err error) { // (img *BWImage, err er
 				return
 			}
 
-			b, err = readU8(r)
+			b, err = br.ReadByte()
 			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+
 				err = prbuferr("reading rll data", err)
 
 				return
 			}
 
-			if color == Black {
-				color = White
-			} else {
-				color = Black
-			}
+			black = !black
 		}
 
-		iimg.Set(int(xindex), int(yindex), color)
+		// the run, up to the end of the row
+		n := min(int(b), conf.Width-xindex)
+		if black {
+			bm.setRun(xindex, yindex, n)
+		}
 
-		b--
-		xindex++
+		b -= uint8(n)
+		xindex += n
 		if xindex >= conf.Width {
 			yindex++
 			xindex = 0
-			color = White
+			black = false
 		}
 	}
 }
 
-// https://sps-support.honeywell.com/s/article/How-can-the-Fingerprint-PRBUF-command-used-to-print-an-image
-func Encode(i image.Image, w io.Writer) {
-	bw := bufio.NewWriter(w)
-	bw.WriteByte(0x40) // header
-	bw.WriteByte(0x02)
+// EncoderOptions controls how colors are mapped to black and white
+type EncoderOptions struct {
+	// Threshold reports whether c is printed black, nil is IsDark
+	Threshold func(c color.Color) bool
 
-	width, height := i.Bounds().Dx(), i.Bounds().Dy()
-	var bufs = make([]byte, 2)
-	binary.BigEndian.PutUint16(bufs, uint16(width))
-	bw.Write(bufs) // width
+	// Invert swaps black and white after Threshold
+	Invert bool
+}
 
-	binary.BigEndian.PutUint16(bufs, uint16(height))
-	bw.Write(bufs) // height
+// DefaultThreshold is the Threshold of nil EncoderOptions
+func DefaultThreshold(c color.Color) bool {
+	return IsDark(c)
+}
 
-	var state, oldState bool = false, false
-	var stateC int
+// blackFunc returns whether pixels of i are printed black, with fast paths
+// for *Bitmap, *image.Gray and *image.Paletted
+func (o *EncoderOptions) blackFunc(i image.Image) func(x, y int) bool {
+	threshold := o.Threshold
+	if threshold == nil {
+		threshold = DefaultThreshold
+	}
 
-	var b []uint8
-	add := func(i byte) {
-		b = append(b, i)
+	is := func(c color.Color) bool {
+		return threshold(c) != o.Invert
 	}
 
-	writeRL := func(rl int) {
-		//log.Printf("rl: %d", rl)
+	switch i := i.(type) {
+	case *Bitmap:
+		black, white := is(Black), is(White)
+
+		// only called within the bounds
+		return func(x, y int) bool {
+			p, mask := i.PixOffset(x, y)
+			if i.Pix[p]&mask != 0 {
+				return black
+			}
 
-		for stateC > 0 {
-			if stateC > MAX_LEN {
-				stateC -= MAX_LEN
+			return white
+		}
 
-				bw.WriteByte(MAX_LEN)
-				bw.WriteByte(0x00)
-				add(MAX_LEN)
-				add(0x00)
-			} else {
-				l := byte(uint8(stateC))
-				bw.WriteByte(l)
-				add(l)
+	case *image.Gray:
+		var lut [256]bool
+		for v := range lut {
+			lut[v] = is(color.Gray{Y: uint8(v)})
+		}
 
-				stateC = -1
-			}
+		return func(x, y int) bool {
+			return lut[i.Pix[i.PixOffset(x, y)]]
 		}
 
-		oldState = state
+	case *image.Paletted:
+		var lut [256]bool
+		for v, c := range i.Palette {
+			lut[v] = is(c)
+		}
+
+		return func(x, y int) bool {
+			return lut[i.Pix[i.PixOffset(x, y)]]
+		}
 	}
 
-	bm, mx := i.Bounds().Min, i.Bounds().Max
+	return func(x, y int) bool {
+		return is(i.At(x, y))
+	}
+}
 
-	for y := bm.Y; y < mx.Y; y++ {
-		for x := bm.X; x < mx.X; x++ {
-			c := i.At(x, y)
-			state = IsBlack(c)
-			if state != oldState {
-				// write length of states for this color
-				if x == 0 {
-					bw.WriteByte(0x00) // change color for first pixaddressen
-				}
+// Encode writes i as PRBUF with the default EncoderOptions
+func Encode(i image.Image, w io.Writer) error {
+	return (&EncoderOptions{}).Encode(i, w)
+}
 
-				writeRL(stateC)
-				stateC = 0
-			}
+// Encode writes i as PRBUF, width and height have to be within 1 and MAX_SIZE
+//
+// https://sps-support.honeywell.com/s/article/How-can-the-Fingerprint-PRBUF-command-used-to-print-an-image
+func (o *EncoderOptions) Encode(i image.Image, w io.Writer) (err error) {
+	if o == nil {
+		o = &EncoderOptions{}
+	}
+
+	b := i.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	if width < 1 || height < 1 || width > MAX_SIZE || height > MAX_SIZE {
+		return fmt.Errorf("prbuf: %w: %dx%d, 1 to %d dots each", ErrInvalidSize, width, height, MAX_SIZE)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0x40, 0x02}) // header
 
-			stateC++
-			oldState = state
+	bw.Write(binary.BigEndian.AppendUint16(nil, uint16(width)))
+	bw.Write(binary.BigEndian.AppendUint16(nil, uint16(height)))
+
+	// runs of up to MAX_LEN, longer ones are continued after an empty run
+	// of the other color
+	writeRun := func(n int) {
+		for ; n > MAX_LEN; n -= MAX_LEN {
+			bw.WriteByte(MAX_LEN)
+			bw.WriteByte(0x00)
 		}
 
-		writeRL(stateC)
-		stateC = 0
+		bw.WriteByte(byte(n))
+	}
+
+	black := o.blackFunc(i)
 
-		state, oldState = false, false
+	// every row starts with a black run, empty if the first pixel is white
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		run, runBlack := 0, true
 
-		// ---
-		var ttl int
-		for _, c := range b {
-			ttl += int(c)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if black(x, y) != runBlack {
+				writeRun(run)
+				run, runBlack = 0, !runBlack
+			}
+
+			run++
 		}
 
-		b = make([]uint8, 0)
+		writeRun(run)
 	}
 
-	// close
-	bw.Flush()
+	// bufio keeps the first write error
+	err = bw.Flush()
+	if err != nil {
+		return fmt.Errorf("prbuf: writing: %w", err)
+	}
 
 	return
 }
@@ -0,0 +1,287 @@
+package prbuf
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// label is a 800x1200 label of boxes, lines and a dithered gradient
+func label() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 800, 1200))
+
+	for y := 0; y < 1200; y++ {
+		for x := 0; x < 800; x++ {
+			v := uint8(0xff)
+
+			switch {
+			case x < 20 || x >= 780 || y < 20 || y >= 1180: // border
+				v = 0
+			case y >= 100 && y < 400 && (x/40+y/40)%2 == 0: // checkerboard
+				v = 0
+			case y >= 500 && y < 700 && x%7 < 3: // barcode like lines
+				v = 0
+			case y >= 800 && y < 1100 && (x*x+y*7)%251 < x*251/800: // gradient
+				v = 0
+			}
+
+			img.SetGray(x, y, color.Gray{Y: v})
+		}
+	}
+
+	return img
+}
+
+func BenchmarkDecode(b *testing.B) {
+	buf := new(bytes.Buffer)
+	err := Encode(label(), buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkEncode(b *testing.B, img image.Image) {
+	for i := 0; i < b.N; i++ {
+		err := Encode(img, io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeBitmap(b *testing.B) {
+	src := label()
+	img := NewBitmap(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+
+	benchmarkEncode(b, img)
+}
+
+func BenchmarkEncodeGray(b *testing.B) {
+	benchmarkEncode(b, label())
+}
+
+func BenchmarkEncodePaletted(b *testing.B) {
+	src := label()
+	img := image.NewPaletted(src.Bounds(), color.Palette{color.White, color.Black})
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+
+	benchmarkEncode(b, img)
+}
+
+func BenchmarkEncodeRGBA(b *testing.B) {
+	src := label()
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, image.Point{}, draw.Src)
+
+	benchmarkEncode(b, img)
+}
+
+// randomBitmap returns a bitmap of r with random pixels, every third row is
+// all black or all white
+func randomBitmap(rnd *rand.Rand, r image.Rectangle) *Bitmap {
+	b := NewBitmap(r)
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			switch (y - r.Min.Y) % 6 {
+			case 2:
+				b.SetBlack(x, y, true)
+			case 5:
+			default:
+				b.SetBlack(x, y, rnd.Intn(3) == 0)
+			}
+		}
+	}
+
+	return b
+}
+
+// sizes the runs and rows of prbuf are likely to get wrong
+var testRects = []image.Rectangle{
+	image.Rect(0, 0, 1, 1),
+	image.Rect(0, 0, 1, 40),
+	image.Rect(0, 0, 40, 1),
+	image.Rect(0, 0, 7, 9),
+	image.Rect(0, 0, 8, 8),
+	image.Rect(0, 0, 13, 5),
+	image.Rect(0, 0, 127, 6),
+	image.Rect(0, 0, 128, 6),
+	image.Rect(0, 0, 254, 6),
+	image.Rect(0, 0, 255, 6),
+	image.Rect(0, 0, 300, 12),
+	image.Rect(-5, 7, 61, 20),
+	image.Rect(3, -9, 130, 2),
+}
+
+// roundTrip encodes img with o and decodes it again
+func roundTrip(t *testing.T, o *EncoderOptions, img image.Image) *Bitmap {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	err := o.Encode(img, buf)
+	if err != nil {
+		t.Fatalf("%v: %v", img.Bounds(), err)
+	}
+
+	// the printer takes runs of at most MAX_LEN
+	for i, n := range buf.Bytes()[6:] {
+		if n > MAX_LEN {
+			t.Fatalf("%v: run %d of %d dots", img.Bounds(), i, n)
+		}
+	}
+
+	out, err := Decode(buf)
+	if err != nil {
+		t.Fatalf("%v: %v", img.Bounds(), err)
+	}
+
+	bm := out.(*Bitmap)
+	if bm.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("%v: decoded %v", img.Bounds(), bm.Bounds())
+	}
+
+	return bm
+}
+
+// compare checks every pixel of out against want of the pixel of the source
+// at the same offset from Bounds().Min
+func compare(t *testing.T, name string, src image.Rectangle, out *Bitmap, want func(x, y int) bool) {
+	t.Helper()
+
+	for y := src.Min.Y; y < src.Max.Y; y++ {
+		for x := src.Min.X; x < src.Max.X; x++ {
+			got := out.BlackAt(x-src.Min.X, y-src.Min.Y)
+			if got != want(x, y) {
+				t.Fatalf("%s %v: pixel (%d, %d) is black %t, want %t", name, src, x, y, got, want(x, y))
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, r := range testRects {
+		for i := 0; i < 5; i++ {
+			src := randomBitmap(rnd, r)
+
+			out := roundTrip(t, nil, src)
+			compare(t, "default", r, out, src.BlackAt)
+
+			out = roundTrip(t, &EncoderOptions{Invert: true}, src)
+			compare(t, "invert", r, out, func(x, y int) bool {
+				return !src.BlackAt(x, y)
+			})
+		}
+	}
+}
+
+// the generic and the lookup table paths have to apply Threshold alike
+func TestRoundTripThreshold(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+
+	threshold := func(c color.Color) bool {
+		return color.GrayModel.Convert(c).(color.Gray).Y < 100
+	}
+
+	for _, r := range testRects {
+		gray := image.NewGray(r)
+		for i := range gray.Pix {
+			gray.Pix[i] = uint8(rnd.Intn(256))
+		}
+
+		pal := image.NewPaletted(r, color.Palette{color.Black, color.Gray{Y: 99}, color.Gray{Y: 100}, color.White})
+		for i := range pal.Pix {
+			pal.Pix[i] = uint8(rnd.Intn(len(pal.Palette)))
+		}
+
+		rgba := image.NewRGBA(r)
+		draw.Draw(rgba, r, gray, r.Min, draw.Src)
+
+		for _, img := range []image.Image{gray, pal, rgba} {
+			for _, invert := range []bool{false, true} {
+				o := &EncoderOptions{Threshold: threshold, Invert: invert}
+
+				out := roundTrip(t, o, img)
+				compare(t, "threshold", r, out, func(x, y int) bool {
+					return threshold(img.At(x, y)) != invert
+				})
+			}
+		}
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	tests := []struct {
+		w, h int
+		ok   bool
+	}{
+		{0, 1, false},
+		{1, 0, false},
+		{0, 0, false},
+		{65536, 1, false},
+		{1, 65536, false},
+		{65535, 1, true},
+		{1, 65535, true},
+	}
+
+	for _, tt := range tests {
+		img := image.NewGray(image.Rect(0, 0, tt.w, tt.h))
+
+		err := Encode(img, io.Discard)
+		if tt.ok && err != nil {
+			t.Errorf("%dx%d: %v", tt.w, tt.h, err)
+		}
+
+		if !tt.ok && !errors.Is(err, ErrInvalidSize) {
+			t.Errorf("%dx%d: got %v, want ErrInvalidSize", tt.w, tt.h, err)
+		}
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+// failingWriter fails once n bytes were written
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+
+		return n, errWrite
+	}
+
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestEncodeWriteError(t *testing.T) {
+	img := label()
+
+	// the header, the first buffered chunk and in the middle
+	for _, n := range []int{0, 4096, 20000} {
+		err := Encode(img, &failingWriter{n: n})
+		if !errors.Is(err, errWrite) {
+			t.Errorf("failing after %d bytes: got %v, want %v", n, err, errWrite)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"image/color"
 
 	"bytes"
+	"context"
 	_ "embed"
 	"log"
 )
@@ -49,11 +50,36 @@ func (s *subImage) At(x, y int) color.Color {
 	return s.img.At(tx, ty)
 }
 
+// PrintChunked sends img in strips of 100 rows; anything outside of the
+// printable area is left out if the printer was probed
 func (printer *Printer) PrintChunked(img image.Image, xoff, yoff int) (err error) {
+	return printer.PrintChunkedContext(context.Background(), img, xoff, yoff)
+}
+
+// PrintChunkedContext is PrintChunked stopping between strips once ctx is
+// done, the strips sent so far stay on the canvas
+func (printer *Printer) PrintChunkedContext(ctx context.Context, img image.Image, xoff, yoff int) (err error) {
+	return printer.PrintChunkedProgress(ctx, img, xoff, yoff, nil)
+}
+
+// PrintChunkedProgress is PrintChunkedContext calling progress, if not nil,
+// after every strip with the number of strips sent and the total
+func (printer *Printer) PrintChunkedProgress(ctx context.Context, img image.Image, xoff, yoff int, progress func(sent, total int)) (err error) {
 	size := img.Bounds().Size()
 
 	var totalx, totaly = size.X, size.Y
 
+	// sending it would fail with "Field out of label"
+	if c := printer.Caps; c != nil {
+		if c.Width > 0 {
+			totalx = min(totalx, c.Width-xoff)
+		}
+
+		if c.Length > 0 {
+			totaly = min(totaly, c.Length-yoff)
+		}
+	}
+
 	var blocksizey = 100
 
 	var blocksizex = totalx
@@ -68,12 +94,18 @@ func (printer *Printer) PrintChunked(img image.Image, xoff, yoff int) (err error
 	log.Printf(" - blcksizex %d", blocksizex)
 	log.Printf(" - blcksizey %d", blocksizey)
 
+	var sent, total = 0, ceilDiv(totalx, blocksizex) * ceilDiv(totaly, blocksizey)
+
 	for x := 0; x < totalx; x += blocksizex {
 		for y := 0; y < totaly; y += blocksizey {
 			// TODO: center or sth
+			err = ctx.Err()
+			if err != nil {
+				return
+			}
 
 			// prepare image
-			err = printer.PrintPos(x+xoff, y+yoff)
+			err = printer.PrintPosContext(ctx, x+xoff, y+yoff)
 			if err != nil {
 				return
 			}
@@ -96,13 +128,25 @@ func (printer *Printer) PrintChunked(img image.Image, xoff, yoff int) (err error
 				return
 			}
 
-			var res *Response
-			res, err = printer.ReadResponse()
-			if err != nil && res.Status != "Ok" {
+			_, err = printer.ReadResponseContext(ctx)
+			if err != nil {
 				return
 			}
+
+			sent++
+			if progress != nil {
+				progress(sent, total)
+			}
 		}
 	}
 
 	return nil
 }
+
+func ceilDiv(a, b int) int {
+	if b <= 0 {
+		return 0
+	}
+
+	return (a + b - 1) / b
+}
@@ -2,11 +2,14 @@ package fp
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"time"
 )
 
 const (
@@ -22,13 +25,7 @@ func OpenPrinter(path string) (p *Printer, err error) {
 		return
 	}
 
-	p = &Printer{
-
-		Conn:      conn,
-		resReader: bufio.NewReader(conn),
-	}
-
-	return p, nil
+	return NewPrinter(conn), nil
 }
 
 // address has to be specified with port
@@ -38,17 +35,31 @@ func DialPrinter(address string) (p *Printer, err error) {
 		return
 	}
 
-	p = &Printer{
+	return NewPrinter(conn), nil
+}
+
+// NewPrinter wraps an already established connection
+func NewPrinter(conn PrinterConn) *Printer {
+	return &Printer{
 		Conn:      conn,
 		resReader: bufio.NewReader(conn),
 	}
-
-	return p, nil
 }
 
 type Printer struct {
 	Conn      PrinterConn
 	resReader *bufio.Reader
+
+	// Timeout bounds every round-trip not already bounded by a context
+	// deadline; zero disables the timeout
+	Timeout time.Duration
+
+	// set by Probe; used to clip images to the printable area
+	Caps *Capabilities
+
+	desync  bool          // a round-trip was aborted; resync before next one
+	pending chan struct{} // closed once an abandoned round-trip returns
+	syncseq int
 }
 
 type PrinterConn interface {
@@ -57,7 +68,23 @@ type PrinterConn interface {
 	Close() error
 }
 
+// implemented by net.Conn and pollable *os.File (e.g. ttys)
+type deadlineConn interface {
+	SetDeadline(t time.Time) error
+}
+
+var aLongTimeAgo = time.Unix(1, 0)
+
 func (p *Printer) Read() (res []byte, err error) {
+	err = p.do(context.Background(), func() (err error) {
+		res, err = p.read()
+		return
+	})
+
+	return
+}
+
+func (p *Printer) read() (res []byte, err error) {
 	res, err = p.resReader.ReadBytes('\n')
 	if err != nil {
 		log.Printf("Rec err: %s", err)
@@ -76,6 +103,12 @@ func (p *Printer) Read() (res []byte, err error) {
 }
 
 func (p *Printer) WriteAll(d []byte) (err error) {
+	return p.do(context.Background(), func() error {
+		return p.writeAll(d)
+	})
+}
+
+func (p *Printer) writeAll(d []byte) (err error) {
 	written := 0
 	for written < len(d) {
 		n, err := p.Conn.Write(d[written:])
@@ -90,10 +123,17 @@ func (p *Printer) WriteAll(d []byte) (err error) {
 }
 
 func (p *Printer) SendCommand(msg string) (err error) {
-	enc := EncodeMsg(msg)
-	err = p.WriteAll(enc)
+	return p.SendCommandContext(context.Background(), msg)
+}
+
+func (p *Printer) SendCommandContext(ctx context.Context, msg string) (err error) {
+	return p.do(ctx, func() error {
+		return p.sendCommand(msg)
+	})
+}
 
-	return nil
+func (p *Printer) sendCommand(msg string) (err error) {
+	return p.writeAll(EncodeMsg(msg))
 }
 
 func (p *Printer) SendRaw(r io.Reader) (err error) {
@@ -128,11 +168,56 @@ func (r *Response) Error() string {
 	return fmt.Sprintf("'%s': '%s'", r.Command, r.Status)
 }
 
+func (r *Response) OK() bool {
+	return r.Status == "Ok"
+}
+
+// Err returns the parsed status as *FingerprintError or nil if it was "Ok"
+func (r *Response) Err() error {
+	e := ParseStatus(r.Status)
+	if e == nil {
+		return nil
+	}
+
+	e.Command = r.Command
+	return e
+}
+
 func (p *Printer) ReadResponse() (res *Response, err error) {
+	return p.ReadResponseContext(context.Background())
+}
+
+func (p *Printer) ReadResponseContext(ctx context.Context) (res *Response, err error) {
+	err = p.do(ctx, func() (err error) {
+		res, err = p.readResponse()
+		return
+	})
+
+	return
+}
+
+// ExecContext sends cmd and reads the printers response to it.
+// When ctx is done before the response arrived, ctx.Err() is returned
+// and the printer is resynchronised before the next round-trip.
+func (p *Printer) ExecContext(ctx context.Context, cmd string) (res *Response, err error) {
+	err = p.do(ctx, func() (err error) {
+		err = p.sendCommand(cmd)
+		if err != nil {
+			return
+		}
+
+		res, err = p.readResponse()
+		return
+	})
+
+	return
+}
+
+func (p *Printer) readResponse() (res *Response, err error) {
 	res = new(Response)
 
 	// command
-	cmd, err := p.Read()
+	cmd, err := p.read()
 	if err != nil {
 		return
 	}
@@ -143,7 +228,7 @@ func (p *Printer) ReadResponse() (res *Response, err error) {
 	var buf = make([]byte, 1)
 
 	for {
-		buf, err = p.Read()
+		buf, err = p.read()
 		if err != nil {
 			return
 		}
@@ -157,15 +242,175 @@ func (p *Printer) ReadResponse() (res *Response, err error) {
 	}
 
 	// status code
-	stat, err := p.Read()
+	stat, err := p.read()
 	if err != nil {
 		return
 	}
 
 	res.Status = string(stat)
 
-	if res.Status != "Ok" {
-		err = res
+	err = res.Err()
+	return
+}
+
+// Resync discards everything buffered from the printer and reestablishes
+// the command/response framing by skipping input up to the echo of a marker
+func (p *Printer) Resync(ctx context.Context) (err error) {
+	p.desync = true
+
+	return p.do(ctx, func() error { return nil })
+}
+
+func (p *Printer) resync() (err error) {
+	p.resReader.Reset(p.Conn)
+
+	p.syncseq++
+	marker := fmt.Sprintf("REM libfp-resync-%d", p.syncseq)
+
+	// a cancelled write may have stopped mid-line, the marker would be
+	// appended to it and never echoed on its own
+	err = p.writeAll([]byte(CRLF))
+	if err != nil {
+		return
+	}
+
+	err = p.sendCommand(marker)
+	if err != nil {
+		return
+	}
+
+	var line []byte
+	for string(line) != marker {
+		line, err = p.read()
+		if err != nil {
+			return
+		}
+	}
+
+	// remainder of the markers response
+	_, err = p.readResponseBody()
+	if err != nil {
+		return
+	}
+
+	p.desync = false
+	return
+}
+
+// reads response lines up to the empty line and the status following it
+func (p *Printer) readResponseBody() (status string, err error) {
+	var line = []byte{0}
+	for len(line) != 0 {
+		line, err = p.read()
+		if err != nil {
+			return
+		}
+	}
+
+	line, err = p.read()
+	return string(line), err
+}
+
+// runs fn bounded by ctx and p.Timeout
+func (p *Printer) do(ctx context.Context, fn func() error) (err error) {
+	if p.Timeout > 0 {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+			defer cancel()
+		}
+	}
+
+	// wait for a round-trip abandoned on an uninterruptible conn
+	if p.pending != nil {
+		select {
+		case <-p.pending:
+			p.pending = nil
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if p.desync {
+		f := fn
+		fn = func() (err error) {
+			err = p.resync()
+			if err != nil {
+				return
+			}
+
+			return f()
+		}
+	}
+
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
+
+	if dc, ok := p.Conn.(deadlineConn); ok {
+		dl, _ := ctx.Deadline()
+
+		err = dc.SetDeadline(dl)
+		if err == nil {
+			return p.doDeadline(ctx, dc, fn)
+		}
+
+		if !errors.Is(err, os.ErrNoDeadline) {
+			return
+		}
+	}
+
+	// conn can't be interrupted, leave fn running in the background
+	var ferr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ferr = fn()
+	}()
+
+	select {
+	case <-done:
+		return ferr
+
+	case <-ctx.Done():
+		p.pending = done
+		p.desync = true
+
+		return ctx.Err()
+	}
+}
+
+func (p *Printer) doDeadline(ctx context.Context, dc deadlineConn, fn func() error) (err error) {
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+
+		dc.SetDeadline(aLongTimeAgo)
+	})
+
+	err = fn()
+
+	if !stop() {
+		<-interrupted
+	}
+
+	dc.SetDeadline(time.Time{})
+
+	var fperr *FingerprintError
+	if err != nil && !errors.As(err, &fperr) &&
+		(ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded)) {
+		p.desync = true
+
+		err = ctx.Err()
+		if err == nil { // conn deadline fired before ctx noticed
+			err = context.DeadlineExceeded
+		}
 	}
 
 	return
@@ -174,26 +419,24 @@ func (p *Printer) ReadResponse() (res *Response, err error) {
 // CLL [<nexp>]
 // if field is -1 (i.e. empty) entire canvas is cleared
 func (p *Printer) ClearCanvas(field int) (err error) {
+	return p.ClearCanvasContext(context.Background(), field)
+}
+
+func (p *Printer) ClearCanvasContext(ctx context.Context, field int) (err error) {
 	if field < 0 {
-		err = p.SendCommand("CLL")
+		_, err = p.ExecContext(ctx, "CLL")
 	} else {
-		err = p.SendCommand(fmt.Sprintf("CLL %d", field))
-
-	}
-	if err != nil {
-		return
+		_, err = p.ExecContext(ctx, fmt.Sprintf("CLL %d", field))
 	}
 
-	_, err = p.ReadResponse()
 	return
 }
 
 func (p *Printer) PF(i uint) (err error) {
-	err = p.SendCommand(fmt.Sprintf("PF %d", i))
-	if err != nil {
-		return
-	}
+	return p.PFContext(context.Background(), i)
+}
 
-	_, err = p.ReadResponse()
+func (p *Printer) PFContext(ctx context.Context, i uint) (err error) {
+	_, err = p.ExecContext(ctx, fmt.Sprintf("PF %d", i))
 	return
 }
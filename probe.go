@@ -0,0 +1,97 @@
+package fp
+
+import (
+	"context"
+	"errors"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Capabilities of a printer as reported by Probe, zero if unknown
+type Capabilities struct {
+	Model    string `json:"model,omitempty"`    // VERSION$(1), e.g. "PM43"
+	Firmware string `json:"firmware,omitempty"` // VERSION$(0)
+
+	DPI        int `json:"dpi,omitempty"`         // print resolution
+	Width      int `json:"width,omitempty"`       // print width in dots
+	Length     int `json:"length,omitempty"`      // media length in dots, 0 for continuous media
+	FreeMemory int `json:"free_memory,omitempty"` // free bytes of the tmp: device, not the installed memory
+}
+
+// LabelSize returns the printable area in dots, missing values are taken
+// from def
+func (c *Capabilities) LabelSize(def image.Point) image.Point {
+	return image.Pt(orDefault(c.Width, def.X), orDefault(c.Length, def.Y))
+}
+
+// Resolution returns DPI or DefaultDPI if unknown
+func (c *Capabilities) Resolution() int {
+	return orDefault(c.DPI, DefaultDPI)
+}
+
+// queries are run one by one, a value the firmware does not know only
+// leaves its field empty
+var probeQueries = []struct {
+	cmd string
+	set func(c *Capabilities, v string)
+}{
+	{`PRINT VERSION$(0)`, func(c *Capabilities, v string) { c.Firmware = v }},
+	{`PRINT VERSION$(1)`, func(c *Capabilities, v string) { c.Model = v }},
+
+	{`SETUP GET "PRINTING,PRINT RESOLUTION",A$:PRINT A$`, func(c *Capabilities, v string) { c.DPI = firstInt(v) }},
+	{`SETUP GET "MEDIA,MEDIA SIZE,WIDTH",A$:PRINT A$`, func(c *Capabilities, v string) { c.Width = firstInt(v) }},
+	{`SETUP GET "MEDIA,MEDIA SIZE,LENGTH",A$:PRINT A$`, func(c *Capabilities, v string) { c.Length = firstInt(v) }},
+
+	{`PRINT FRE("tmp:")`, func(c *Capabilities, v string) { c.FreeMemory = firstInt(v) }},
+}
+
+// Probe queries model, firmware, resolution, media size and memory of the
+// printer and stores the result in p.Caps
+func (p *Printer) Probe() (c *Capabilities, err error) {
+	return p.ProbeContext(context.Background())
+}
+
+func (p *Printer) ProbeContext(ctx context.Context) (c *Capabilities, err error) {
+	c = &Capabilities{}
+
+	for _, q := range probeQueries {
+		var res *Response
+		res, err = p.ExecContext(ctx, q.cmd)
+		if err != nil {
+			var fperr *FingerprintError
+			if errors.As(err, &fperr) { // not supported by this firmware
+				continue
+			}
+
+			return nil, err
+		}
+
+		for _, l := range res.Response {
+			if l = strings.TrimSpace(l); l != "" {
+				q.set(c, l)
+				break
+			}
+		}
+	}
+
+	p.Caps = c
+
+	return c, nil
+}
+
+// first integer in s, "832 dots" is 832
+func firstInt(s string) int {
+	start := strings.IndexFunc(s, func(r rune) bool { return r >= '0' && r <= '9' })
+	if start < 0 {
+		return 0
+	}
+
+	end := start
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+
+	n, _ := strconv.Atoi(s[start:end])
+	return n
+}
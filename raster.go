@@ -0,0 +1,258 @@
+package fp
+
+import (
+	// image stuffs
+	"github.com/disintegration/imaging"
+	"github.com/makeworld-the-better-one/dither/v2"
+	"github.com/rileys-trash-can/libfp/prbuf"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"fmt"
+)
+
+// Fit is how images are scaled to the printable area of the label
+type Fit uint8
+
+const (
+	FitNone    Fit = iota // keep the size, crop what does not fit
+	FitShrink             // scale down to fit, never up
+	FitContain            // scale to fit, keeping the aspect ratio
+	FitCover              // scale to cover the area, crop the overflow
+	FitStretch            // scale to the area, ignoring the aspect ratio
+)
+
+// Rotation of images before scaling, clockwise
+type Rotation uint8
+
+const (
+	RotateNone Rotation = iota
+	RotateAuto          // counter-clockwise if the orientation differs from the label
+	Rotate90
+	Rotate180
+	Rotate270
+)
+
+// Placement of images within the printable area, on either axis
+type Placement uint8
+
+const (
+	PlaceStart  Placement = iota // left or top
+	PlaceCenter                  //
+	PlaceEnd                     // right or bottom
+)
+
+// Margins are left white on the sides of the label, in dots
+type Margins struct {
+	Top, Right, Bottom, Left int
+}
+
+// Margin returns equal margins of n dots
+func Margin(n int) Margins {
+	return Margins{n, n, n, n}
+}
+
+// BWPalette is the palette of rasterized images, index 0 is white
+var BWPalette = color.Palette{color.White, color.Black}
+
+// Rasterizer turns any image into a black and white label: rotate, scale,
+// filter, place on the label and dither or threshold
+type Rasterizer struct {
+	// LabelSize is the size of the result in dots; if zero it is the size of
+	// the image after rotating and no scaling is done
+	LabelSize image.Point
+	Margins   Margins
+
+	Fit            Fit
+	Rotate         Rotation
+	AlignH, AlignV Placement
+
+	// Filter is applied after scaling to the image on white, e.g. Filters
+	// from ParseFilters
+	Filter Filter
+
+	// Dither reduces to black and white, if nil pixels darker than Cutoff
+	// (0 to 1) become black; if zero prbuf.IsDark decides like the encoder
+	Dither *dither.Ditherer
+	Cutoff float64
+
+	// Step is called with the name of each step before it runs, for
+	// progress reports; "rotating", "resizing", "filtering", "placing"
+	// and "dithering"
+	Step func(step string)
+}
+
+func (r *Rasterizer) step(name string) {
+	if r.Step != nil {
+		r.Step(name)
+	}
+}
+
+// Rasterize renders img to a label sized black and white image
+func (r *Rasterizer) Rasterize(img image.Image) (out *image.Paletted, err error) {
+	area := r.LabelSize.Sub(image.Pt(r.Margins.Left+r.Margins.Right, r.Margins.Top+r.Margins.Bottom))
+	if r.LabelSize != (image.Point{}) && (area.X <= 0 || area.Y <= 0) {
+		return nil, fmt.Errorf("margins %+v leave nothing of the label %dx%d", r.Margins, r.LabelSize.X, r.LabelSize.Y)
+	}
+
+	if img.Bounds().Empty() {
+		return nil, fmt.Errorf("image is empty")
+	}
+
+	r.step("rotating")
+	img = r.rotate(img, area)
+
+	if r.LabelSize == (image.Point{}) {
+		area = img.Bounds().Size()
+	}
+
+	r.step("resizing")
+	img = r.resize(img, area)
+
+	if r.Filter != nil {
+		r.step("filtering")
+		img = r.Filter.Apply(flatten(img))
+	}
+
+	r.step("placing")
+	size := r.LabelSize
+	if size == (image.Point{}) {
+		size = area.Add(image.Pt(r.Margins.Left+r.Margins.Right, r.Margins.Top+r.Margins.Bottom))
+	}
+
+	canvas := image.NewRGBA(image.Rectangle{Max: size})
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+
+	s := img.Bounds().Size()
+	at := image.Pt(
+		r.Margins.Left+align(r.AlignH, area.X, s.X),
+		r.Margins.Top+align(r.AlignV, area.Y, s.Y),
+	)
+
+	// only the printable area, the overflow of FitNone is cut off
+	clip := image.Rectangle{Max: area}.Add(image.Pt(r.Margins.Left, r.Margins.Top))
+	dr := clip.Intersect(image.Rectangle{Min: at, Max: at.Add(s)})
+	draw.Draw(canvas, dr, img, img.Bounds().Min.Add(dr.Min.Sub(at)), draw.Over)
+
+	r.step("dithering")
+	var bw image.Image = canvas
+	if r.Dither != nil {
+		bw = r.Dither.Dither(canvas)
+	}
+
+	return toPaletted(bw, r.Cutoff), nil
+}
+
+func (r *Rasterizer) rotate(img image.Image, area image.Point) image.Image {
+	switch r.Rotate {
+	case RotateAuto:
+		s := img.Bounds().Size()
+		if r.LabelSize != (image.Point{}) && (area.X > area.Y) != (s.X > s.Y) {
+			return imaging.Rotate90(img)
+		}
+
+	// imaging rotates counter-clockwise
+	case Rotate90:
+		return imaging.Rotate270(img)
+	case Rotate180:
+		return imaging.Rotate180(img)
+	case Rotate270:
+		return imaging.Rotate90(img)
+	}
+
+	return img
+}
+
+func (r *Rasterizer) resize(img image.Image, area image.Point) image.Image {
+	s := img.Bounds().Size()
+
+	// scale to fit, keeping the aspect ratio
+	contain := func() image.Image {
+		scale := min(float64(area.X)/float64(s.X), float64(area.Y)/float64(s.Y))
+
+		return imaging.Resize(img,
+			max(1, int(float64(s.X)*scale+.5)),
+			max(1, int(float64(s.Y)*scale+.5)),
+			imaging.Lanczos)
+	}
+
+	switch r.Fit {
+	case FitShrink:
+		if s.X > area.X || s.Y > area.Y {
+			return contain()
+		}
+
+	case FitContain:
+		if s != area {
+			return contain()
+		}
+
+	case FitCover:
+		return imaging.Fill(img, area.X, area.Y, anchor(r.AlignH, r.AlignV), imaging.Lanczos)
+
+	case FitStretch:
+		return imaging.Resize(img, area.X, area.Y, imaging.Lanczos)
+	}
+
+	return img
+}
+
+// align returns the offset of size within space
+func align(a Placement, space, size int) int {
+	switch a {
+	case PlaceCenter:
+		return space/2 - size/2
+	case PlaceEnd:
+		return space - size
+	}
+
+	return 0
+}
+
+func anchor(h, v Placement) imaging.Anchor {
+	return [3][3]imaging.Anchor{
+		{imaging.TopLeft, imaging.Top, imaging.TopRight},
+		{imaging.Left, imaging.Center, imaging.Right},
+		{imaging.BottomLeft, imaging.Bottom, imaging.BottomRight},
+	}[v][h]
+}
+
+// flatten composites img onto white, filters would see transparent pixels
+// as black while they are printed as the white of the label
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	return out
+}
+
+// toPaletted maps img to BWPalette, pixels darker than cutoff become black,
+// prbuf.IsDark decides if it is zero
+func toPaletted(img image.Image, cutoff float64) *image.Paletted {
+	b := img.Bounds()
+	out := image.NewPaletted(image.Rectangle{Max: b.Size()}, BWPalette)
+
+	dark := prbuf.IsDark
+	if cutoff != 0 {
+		limit := uint16(cutoff * 0xffff)
+		dark = func(c color.Color) bool {
+			return color.Gray16Model.Convert(c).(color.Gray16).Y < limit
+		}
+	}
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if dark(img.At(x, y)) {
+				out.SetColorIndex(x-b.Min.X, y-b.Min.Y, 1)
+			}
+		}
+	}
+
+	return out
+}
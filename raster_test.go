@@ -0,0 +1,49 @@
+package fp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// transparent pixels are the white of the label, also after filtering
+func TestRasterizeTransparent(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ { // left half opaque black, the rest transparent
+			src.SetNRGBA(x, y, color.NRGBA{A: 0xff})
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+	}{
+		{"none", nil},
+		{"threshold", Threshold(.5)},
+		{"gamma", Gamma(1.5)},
+		{"contrast", Contrast(50)},
+		{"unsharp", UnsharpMask(1, 1)},
+		{"autolevels", AutoLevels(.5)},
+	}
+
+	for _, tt := range tests {
+		r := &Rasterizer{Filter: tt.filter}
+
+		out, err := r.Rasterize(src)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// away from the edge unsharp sharpens
+		for y := 0; y < 10; y++ {
+			if out.ColorIndexAt(2, y) != 1 {
+				t.Errorf("%s: opaque black pixel (2, %d) is white", tt.name, y)
+			}
+
+			if out.ColorIndexAt(17, y) != 0 {
+				t.Errorf("%s: transparent pixel (17, %d) is black", tt.name, y)
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package fp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnState is the state of a Reconnectors connection
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	}
+
+	return "unknown"
+}
+
+// Reconnector keeps a Printer connected: connections found broken are
+// closed and redialed with exponential backoff on the next use, Setup is run
+// after every connect. Use is serialised, only one Do runs at a time.
+type Reconnector struct {
+	// Dial opens a new connection, see DialFunc and OpenFunc
+	Dial func(ctx context.Context) (PrinterConn, error)
+
+	// Setup is run on every new connection before it is used, e.g. to beep
+	// or Probe; an error closes the connection and counts as failed attempt
+	Setup func(ctx context.Context, p *Printer) error
+
+	// OnStateChange is called on every state change, err is the cause of
+	// a disconnect or failed attempt
+	OnStateChange func(state ConnState, err error)
+
+	MinBackoff time.Duration // 1s if zero
+	MaxBackoff time.Duration // 30s if zero
+
+	// copied to every Printer
+	Timeout time.Duration
+
+	mu sync.Mutex // held while connecting or in Do
+	p  *Printer
+
+	smu   sync.Mutex // guards state and caps
+	state ConnState
+	caps  *Capabilities
+}
+
+// DialFunc returns a Reconnector.Dial connecting to a tcp address with port
+func DialFunc(address string) func(ctx context.Context) (PrinterConn, error) {
+	return func(ctx context.Context) (PrinterConn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	}
+}
+
+// OpenFunc returns a Reconnector.Dial opening a serial device
+func OpenFunc(path string) func(ctx context.Context) (PrinterConn, error) {
+	return func(ctx context.Context) (PrinterConn, error) {
+		return os.OpenFile(path, os.O_RDWR, 0)
+	}
+}
+
+// State returns the current connection state
+func (r *Reconnector) State() ConnState {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	return r.state
+}
+
+// Caps returns the capabilities of the last connected printer, nil if it
+// was never probed
+func (r *Reconnector) Caps() *Capabilities {
+	r.smu.Lock()
+	defer r.smu.Unlock()
+
+	return r.caps
+}
+
+// Connect connects if not already connected, retrying until ctx is done
+func (r *Reconnector) Connect(ctx context.Context) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err = r.connect(ctx)
+	return
+}
+
+// Do runs fn with a connected printer, connecting first if needed. When
+// fn fails because the connection broke it is closed and redialed by the
+// next Do; fn is not retried as it may already have printed.
+func (r *Reconnector) Do(ctx context.Context, fn func(p *Printer) error) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, err := r.connect(ctx)
+	if err != nil {
+		return
+	}
+
+	err = fn(p)
+
+	r.smu.Lock()
+	r.caps = T(p.Caps != nil, p.Caps, r.caps)
+	r.smu.Unlock()
+
+	if connBroken(err) {
+		r.drop(err)
+	}
+
+	return
+}
+
+// Close closes the current connection, a later Do reconnects
+func (r *Reconnector) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.p != nil {
+		err = r.p.Conn.Close()
+		r.p = nil
+		r.setState(StateDisconnected, nil)
+	}
+
+	return
+}
+
+func (r *Reconnector) connect(ctx context.Context) (p *Printer, err error) {
+	if r.p != nil {
+		return r.p, nil
+	}
+
+	backoff := T(r.MinBackoff > 0, r.MinBackoff, time.Second)
+	maxBackoff := T(r.MaxBackoff > 0, r.MaxBackoff, 30*time.Second)
+
+	for {
+		r.setState(StateConnecting, nil)
+
+		p, err = r.dial(ctx)
+		if err == nil {
+			r.p = p
+			r.setState(StateConnected, nil)
+
+			return
+		}
+
+		r.setState(StateDisconnected, err)
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (r *Reconnector) dial(ctx context.Context) (p *Printer, err error) {
+	conn, err := r.Dial(ctx)
+	if err != nil {
+		return
+	}
+
+	p = NewPrinter(conn)
+	p.Timeout = r.Timeout
+	p.Caps = r.Caps()
+
+	if r.Setup != nil {
+		err = r.Setup(ctx, p)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	r.smu.Lock()
+	r.caps = T(p.Caps != nil, p.Caps, r.caps)
+	r.smu.Unlock()
+
+	return
+}
+
+func (r *Reconnector) drop(err error) {
+	r.p.Conn.Close()
+	r.p = nil
+
+	r.setState(StateDisconnected, err)
+}
+
+func (r *Reconnector) setState(state ConnState, err error) {
+	r.smu.Lock()
+	changed := r.state != state
+	r.state = state
+	r.smu.Unlock()
+
+	if r.OnStateChange != nil && (changed || err != nil) {
+		r.OnStateChange(state, err)
+	}
+}
+
+// errors after which the connection can't be used anymore; a timed out
+// round-trip counts as printers that lost power don't reset the connection
+func connBroken(err error) bool {
+	var fperr *FingerprintError
+	if err == nil || errors.As(err, &fperr) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var operr *net.OpError
+	var patherr *fs.PathError
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &operr) || errors.As(err, &patherr)
+}
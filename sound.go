@@ -2,6 +2,7 @@ package fp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 )
 
@@ -11,6 +12,10 @@ type Sound struct {
 }
 
 func (p *Printer) Beep(notes ...Sound) (err error) {
+	return p.BeepContext(context.Background(), notes...)
+}
+
+func (p *Printer) BeepContext(ctx context.Context, notes ...Sound) (err error) {
 	buf := new(bytes.Buffer)
 
 	for i := 0; i < len(notes); i++ {
@@ -23,12 +28,7 @@ func (p *Printer) Beep(notes ...Sound) (err error) {
 		}
 	}
 
-	err = p.SendCommand(buf.String())
-	if err != nil {
-		return
-	}
-
-	_, err = p.ReadResponse()
+	_, err = p.ExecContext(ctx, buf.String())
 	return
 }
 
@@ -1,28 +1,24 @@
 package fp
 
 import (
+	"context"
 	"fmt"
-	"strings"
 )
 
 func (p *Printer) PrintPos(x, y int) (err error) {
-	err = p.SendCommand(fmt.Sprintf("PP %d,%d", x, y))
-	if err != nil {
-		return
-	}
-
-	_, err = p.ReadResponse()
+	return p.PrintPosContext(context.Background(), x, y)
+}
 
+func (p *Printer) PrintPosContext(ctx context.Context, x, y int) (err error) {
+	_, err = p.ExecContext(ctx, fmt.Sprintf("PP %d,%d", x, y))
 	return
 }
 
 func (p *Printer) PRText(txt string) (err error) {
-	err = p.SendCommand(fmt.Sprintf("PRTXT \"%s\"",
-		strings.ReplaceAll(strings.ReplaceAll(txt, "\n", "\\n"), "\"", "\\\"")))
-	if err != nil {
-		return
-	}
+	return p.PRTextContext(context.Background(), txt)
+}
 
-	_, err = p.ReadResponse()
+func (p *Printer) PRTextContext(ctx context.Context, txt string) (err error) {
+	_, err = p.ExecContext(ctx, "PRTXT "+Quote(txt))
 	return
 }
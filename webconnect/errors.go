@@ -0,0 +1,82 @@
+package webconnect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sentinels for use with errors.Is, matching is done by StatusCode only
+var (
+	ErrBadRequest   = &APIError{StatusCode: http.StatusBadRequest}   // invalid parameters, job too large
+	ErrUnauthorized = &APIError{StatusCode: http.StatusUnauthorized} // missing or invalid token
+	ErrForbidden    = &APIError{StatusCode: http.StatusForbidden}    // admin only or quota exceeded
+	ErrNotFound     = &APIError{StatusCode: http.StatusNotFound}
+	ErrConflict     = &APIError{StatusCode: http.StatusConflict} // job not queued anymore
+	ErrUnsupported  = &APIError{StatusCode: http.StatusUnsupportedMediaType}
+	ErrRateLimited  = &APIError{StatusCode: http.StatusTooManyRequests}
+)
+
+// APIError is returned when fpweb answered with a non 2xx status
+type APIError struct {
+	StatusCode int
+	Message    string // from the json error, the body otherwise
+
+	RetryAfter time.Duration // of rate limited requests
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("fpweb: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("fpweb: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	t, ok := target.(*APIError)
+	if !ok {
+		return false
+	}
+
+	return t.StatusCode != 0 && t.StatusCode == e.StatusCode
+}
+
+// JobFailedError is returned by Wait for jobs that failed or were cancelled
+type JobFailedError struct {
+	Status *Status
+}
+
+func (e *JobFailedError) Error() string {
+	return fmt.Sprintf("fpweb: job %s failed: %s", e.Status.JobID, e.Status.Message)
+}
+
+func responseError(res *http.Response) *APIError {
+	e := &APIError{StatusCode: res.StatusCode}
+
+	if s := res.Header.Get("Retry-After"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err == nil {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+	}
+
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+
+	var body struct {
+		Error string `json:"error"`
+	}
+
+	err := json.Unmarshal(b, &body)
+	if err == nil && body.Error != "" {
+		e.Message = body.Error
+	} else {
+		e.Message = strings.TrimSpace(string(b))
+	}
+
+	return e
+}
@@ -0,0 +1,86 @@
+package webconnect
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ImageInfo describes an image stored by fpweb
+type ImageInfo struct {
+	ID          uuid.UUID  `json:"id"`
+	Name        string     `json:"name"`
+	Ext         string     `json:"ext"` // format, e.g. png
+	Public      bool       `json:"public"`
+	Owner       uint       `json:"owner"`
+	IsProcessed bool       `json:"is_processed"`
+	UnProcessed *uuid.UUID `json:"unprocessed,omitempty"` // of processed images
+	Processed   *uuid.UUID `json:"processed,omitempty"`   // of unprocessed images
+	Created     time.Time  `json:"created"`
+}
+
+type ImagePage struct {
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	Total  int `json:"total"`
+
+	Images []ImageInfo `json:"images"`
+}
+
+// Images lists the images visible to the client, newest first; limit is at
+// most 100, 0 uses the servers default
+func (c *Client) Images(ctx context.Context, offset, limit int) (*ImagePage, error) {
+	u, err := c.url("images")
+	if err != nil {
+		return nil, err
+	}
+
+	v := url.Values{"offset": []string{strconv.Itoa(offset)}}
+	if limit > 0 {
+		v.Set("limit", strconv.Itoa(limit))
+	}
+
+	u.RawQuery = v.Encode()
+
+	req, err := c.request(ctx, "GET", u, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	page := new(ImagePage)
+	return page, c.decode(req, page)
+}
+
+// Image describes image id
+func (c *Client) Image(ctx context.Context, id uuid.UUID) (*ImageInfo, error) {
+	info := new(ImageInfo)
+	return info, c.doJSON(ctx, "GET", nil, info, "images", id.String())
+}
+
+// ImageData returns the file of image id and its content type
+func (c *Client) ImageData(ctx context.Context, id uuid.UUID) (data []byte, contentType string, err error) {
+	u, err := c.url("images", id.String(), "data")
+	if err != nil {
+		return
+	}
+
+	req, err := c.request(ctx, "GET", u, "", nil)
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Accept", "*/*")
+
+	res, err := c.do(req)
+	if err != nil {
+		return
+	}
+
+	defer res.Body.Close()
+
+	data, err = io.ReadAll(res.Body)
+	return data, res.Header.Get("Content-Type"), err
+}
@@ -0,0 +1,285 @@
+package webconnect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	"image"
+	"io"
+	"mime/multipart"
+	"strings"
+	"time"
+)
+
+type Dither string
+
+// see fp.DitherFromString, error diffusion ones can be made serpentine
+// with Dither.Serpentine
+const (
+	DitherNone   Dither = ""
+	DitherO4x4   Dither = "o4x4"
+	DitherNoise  Dither = "noise"
+	DitherBayer  Dither = "bayer"
+	DitherBayer8 Dither = "bayer8"
+
+	DitherFloydSteinberg    Dither = "floydsteinberg"
+	DitherAtkinson          Dither = "atkinson"
+	DitherJarvisJudiceNinke Dither = "jjn"
+	DitherStucki            Dither = "stucki"
+	DitherSierra            Dither = "sierra"
+	DitherTwoRowSierra      Dither = "sierra2"
+	DitherSierraLite        Dither = "sierralite"
+	DitherBurkes            Dither = "burkes"
+)
+
+// Serpentine returns d alternating direction every row
+func (d Dither) Serpentine() Dither {
+	return d + "-serpentine"
+}
+
+type PrintJob struct {
+	Image []byte
+	Name  string // of the image, defaults to the date and time
+
+	Printer   string // name, defaults to the first configured printer
+	PFCount   uint   // copies, 0 only processes the image
+	Priority  int    // higher is printed first
+	LabelSize image.Point
+	Ditherer  Dither
+	Filters   string // e.g. "autolevels,unsharp=1.5", see fp.ParseFilters
+
+	Public  bool
+	Resize  bool
+	Stretch bool
+	Rotate  bool
+	Centerh bool
+	Centerv bool
+	Tiling  bool
+}
+
+// request is the PrintRequest of fpweb without the image
+type request struct {
+	ImageID *uuid.UUID `json:"image_id,omitempty"`
+
+	Printer  string `json:"printer,omitempty"`
+	PFCount  uint   `json:"pf"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	Dither   Dither `json:"dither,omitempty"`
+	Filters  string `json:"filters,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Name     string `json:"name,omitempty"`
+
+	Public  bool `json:"public,omitempty"`
+	Resize  bool `json:"resize,omitempty"`
+	Stretch bool `json:"stretch,omitempty"`
+	Rotate  bool `json:"rotate,omitempty"`
+	CenterH bool `json:"centerh,omitempty"`
+	CenterV bool `json:"centerv,omitempty"`
+	Tiling  bool `json:"tiling,omitempty"`
+}
+
+func (p *PrintJob) request() *request {
+	return &request{
+		Printer:  p.Printer,
+		PFCount:  p.PFCount,
+		Width:    p.LabelSize.X,
+		Height:   p.LabelSize.Y,
+		Dither:   p.Ditherer,
+		Filters:  p.Filters,
+		Priority: p.Priority,
+		Name:     p.Name,
+
+		Public:  p.Public,
+		Resize:  p.Resize,
+		Stretch: p.Stretch,
+		Rotate:  p.Rotate,
+		CenterH: p.Centerh,
+		CenterV: p.Centerv,
+		Tiling:  p.Tiling,
+	}
+}
+
+// Status of a job as reported by fpweb
+type Status struct {
+	JobID    uuid.UUID `json:"jobid"`
+	Message  string    `json:"message"` // current step
+	Image    uuid.UUID `json:"image"`   // being printed
+	Preview  uuid.UUID `json:"preview"` // rendering of what is sent to the printer
+	Done     bool      `json:"done"`
+	Progress float32   `json:"progress"` // 0 to 1, -1 if the job failed
+
+	Printer  string `json:"printer"`
+	State    string `json:"state"` // queued, printing or finished
+	Priority int    `json:"priority"`
+}
+
+// Failed reports whether the job failed or was cancelled
+func (s *Status) Failed() bool {
+	return s.Progress < 0
+}
+
+// Print uploads p.Image and queues it, the returned status is the one right
+// after queueing
+func (c *Client) Print(ctx context.Context, p *PrintJob) (*Status, error) {
+	u, err := c.url("jobs")
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := json.Marshal(p.request())
+	if err != nil {
+		return nil, err
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	err = mw.WriteField("request", string(req))
+	if err != nil {
+		return nil, err
+	}
+
+	// parts without a filename are not files, this is fpwebs default name
+	name := p.Name
+	if name == "" {
+		name = time.Now().Format(time.RFC3339)
+	}
+
+	fw, err := mw.CreateFormFile("image", name)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fw.Write(p.Image)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.request(ctx, "POST", u, mw.FormDataContentType(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	s := new(Status)
+	return s, c.decode(r, s)
+}
+
+// Reprint queues the stored image id with the options of p, p.Image and
+// p.Name are ignored
+func (c *Client) Reprint(ctx context.Context, id uuid.UUID, p *PrintJob) (*Status, error) {
+	req := p.request()
+	req.ImageID = &id
+	req.Name = ""
+
+	s := new(Status)
+	return s, c.doJSON(ctx, "POST", req, s, "jobs")
+}
+
+// Job returns the current status of job id
+func (c *Client) Job(ctx context.Context, id uuid.UUID) (*Status, error) {
+	s := new(Status)
+	return s, c.doJSON(ctx, "GET", nil, s, "jobs", id.String())
+}
+
+// Cancel cancels job id, printing jobs stop after the current chunk or label
+func (c *Client) Cancel(ctx context.Context, id uuid.UUID) (*Status, error) {
+	s := new(Status)
+	return s, c.doJSON(ctx, "DELETE", nil, s, "jobs", id.String())
+}
+
+// Stream calls fn (if not nil) with every status update of job id until it
+// is done and returns the last status. Dropped streams are reopened.
+func (c *Client) Stream(ctx context.Context, id uuid.UUID, fn func(*Status)) (*Status, error) {
+	u, err := c.url("jobs", id.String(), "events")
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		req, err := c.request(ctx, "GET", u, "", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Accept", "text/event-stream")
+
+		res, err := c.do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := readEvents(res.Body, fn)
+		res.Body.Close()
+
+		if err != nil && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if s != nil && s.Done {
+			return s, nil
+		}
+
+		// the server closes the stream of subscribers that fell behind
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+}
+
+// readEvents reads server-sent events from r until a status is done or r
+// ends, it returns the last status read
+func readEvents(r io.Reader, fn func(*Status)) (last *Status, err error) {
+	sc := bufio.NewScanner(r)
+
+	for sc.Scan() {
+		data, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok { // comments (pings), blank lines and other fields
+			continue
+		}
+
+		s := new(Status)
+		err = json.Unmarshal([]byte(strings.TrimSpace(data)), s)
+		if err != nil {
+			return last, err
+		}
+
+		last = s
+		if fn != nil {
+			fn(s)
+		}
+
+		if s.Done {
+			return last, nil
+		}
+	}
+
+	err = sc.Err()
+	if err == nil {
+		err = io.EOF
+	}
+
+	return last, err
+}
+
+// Wait blocks until job id is done, a failed or cancelled job is returned
+// as *JobFailedError
+func (c *Client) Wait(ctx context.Context, id uuid.UUID) (*Status, error) {
+	s, err := c.Stream(ctx, id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Failed() {
+		return s, &JobFailedError{Status: s}
+	}
+
+	return s, nil
+}
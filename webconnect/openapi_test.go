@@ -0,0 +1,219 @@
+package webconnect
+
+import (
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the parts of the fpweb spec the client has to agree with
+type spec struct {
+	Paths map[string]map[string]any `yaml:"paths"`
+
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]struct {
+				Type   string `yaml:"type"`
+				Format string `yaml:"format"`
+			} `yaml:"properties"`
+		} `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+func loadSpec(t *testing.T) *spec {
+	b, err := os.ReadFile("../cmd/fpweb/html/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := new(spec)
+	err = yaml.Unmarshal(b, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// specPath returns the path of the spec matching path, "" if none does
+func (s *spec) specPath(path string) string {
+	segs := strings.Split(path, "/")
+
+next:
+	for p := range s.Paths {
+		psegs := strings.Split(p, "/")
+		if len(psegs) != len(segs) {
+			continue
+		}
+
+		for i := range psegs {
+			if psegs[i] != segs[i] && !strings.HasPrefix(psegs[i], "{") {
+				continue next
+			}
+		}
+
+		return p
+	}
+
+	return ""
+}
+
+// schemaType returns the openapi type and format of values of t
+func schemaType(t reflect.Type) (typ, format string) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(uuid.UUID{}):
+		return "string", "uuid"
+
+	case reflect.TypeOf(time.Time{}):
+		return "string", "date-time"
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "string", ""
+
+	case reflect.Bool:
+		return "boolean", ""
+
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return "integer", ""
+
+	case reflect.Float32, reflect.Float64:
+		return "number", ""
+
+	case reflect.Slice:
+		return "array", ""
+	}
+
+	return t.Kind().String(), ""
+}
+
+func TestSpecTypes(t *testing.T) {
+	s := loadSpec(t)
+
+	tests := []struct {
+		schema string
+		value  any
+
+		// all properties are decoded, requests may leave some to other parts
+		response bool
+	}{
+		{"PrintRequest", request{}, false},
+		{"Status", Status{}, true},
+		{"ImageInfo", ImageInfo{}, true},
+		{"ImagePage", ImagePage{}, true},
+	}
+
+	for _, tt := range tests {
+		schema, ok := s.Components.Schemas[tt.schema]
+		if !ok {
+			t.Errorf("schema %s not in the spec", tt.schema)
+			continue
+		}
+
+		rt := reflect.TypeOf(tt.value)
+		fields := make(map[string]bool)
+
+		for i := 0; i < rt.NumField(); i++ {
+			f := rt.Field(i)
+
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				t.Errorf("%s.%s has no json name", rt.Name(), f.Name)
+				continue
+			}
+
+			fields[name] = true
+
+			prop, ok := schema.Properties[name]
+			if !ok {
+				t.Errorf("%s.%s: %s has no property %s", rt.Name(), f.Name, tt.schema, name)
+				continue
+			}
+
+			typ, format := schemaType(f.Type)
+			if typ != prop.Type || (format != "" && format != prop.Format) {
+				t.Errorf("%s.%s is %s %s, %s.%s is %s %s", rt.Name(), f.Name, typ, format,
+					tt.schema, name, prop.Type, prop.Format)
+			}
+		}
+
+		if !tt.response {
+			continue
+		}
+
+		for name := range schema.Properties {
+			if !fields[name] {
+				t.Errorf("%s.%s is not decoded into %s", tt.schema, name, rt.Name())
+			}
+		}
+	}
+}
+
+// every request the client sends has to be in the spec
+func TestSpecPaths(t *testing.T) {
+	s := loadSpec(t)
+
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs = append(reqs, r.Method+" "+r.URL.Path)
+
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"done\":true}\n\n"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, "token")
+	ctx := context.Background()
+	id := uuid.New()
+
+	calls := []func() error{
+		func() error { _, err := c.Print(ctx, &PrintJob{Image: []byte("png")}); return err },
+		func() error { _, err := c.Reprint(ctx, id, &PrintJob{}); return err },
+		func() error { _, err := c.Job(ctx, id); return err },
+		func() error { _, err := c.Cancel(ctx, id); return err },
+		func() error { _, err := c.Stream(ctx, id, nil); return err },
+		func() error { _, err := c.Images(ctx, 0, 10); return err },
+		func() error { _, err := c.Image(ctx, id); return err },
+		func() error { _, _, err := c.ImageData(ctx, id); return err },
+	}
+
+	for _, call := range calls {
+		err := call()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, req := range reqs {
+		method, path, _ := strings.Cut(req, " ")
+
+		p := s.specPath(strings.TrimPrefix(path, "/api/v1"))
+		if p == "" {
+			t.Errorf("%s: path not in the spec", req)
+			continue
+		}
+
+		if _, ok := s.Paths[p][strings.ToLower(method)]; !ok {
+			t.Errorf("%s: %s has no %s", req, p, method)
+		}
+	}
+}
@@ -1,130 +1,144 @@
+// Package webconnect is a client for the /api/v1 of fpweb
 package webconnect
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"encoding/json"
 	"github.com/google/uuid"
-	"image"
+	"io"
 	"net/http"
 	"net/url"
 )
 
-type Dither string
+// Client talks to one fpweb instance
+type Client struct {
+	// BaseURL is the protocol, host and additional path of fpweb, /api/v1
+	// is appended. User info in it is sent as basic auth.
+	BaseURL string
 
-const (
-	DitherO4x4         = "o4x4"
-	DitherNoise        = "noise"
-	DitherBayer Dither = "bayer"
-)
-
-type PrintJob struct {
-	Image []byte
+	// Token is sent as bearer token unless empty
+	Token string
 
-	PFCount   uint
-	LabelSize image.Point
-	Ditherer  Dither
+	// HTTP is used for all requests, http.DefaultClient if nil. A Timeout
+	// set on it also ends Stream and Wait.
+	HTTP *http.Client
+}
 
-	Public  bool
-	Resize  bool
-	Stretch bool
-	Rotate  bool
-	Centerh bool
-	Centerv bool
-	Tiling  bool
+// NewClient returns a client for the fpweb at baseURL authenticating with
+// token, which may be empty
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: baseURL,
+		Token:   token,
+	}
 }
 
-type PrintJobID struct {
-	ID uuid.UUID
+func (c *Client) httpClient() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+
+	return c.HTTP
 }
 
-// Print a printjob at host
-// host should only be the host, protocol and additional path part (the /api/print is appended automatically)
-func Print(host string, p *PrintJob) (jobid *uuid.UUID, err error) {
-	partl, err := url.Parse(host)
+// url returns the url of the api path elements p
+func (c *Client) url(p ...string) (*url.URL, error) {
+	base, err := url.Parse(c.BaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	u := (&url.URL{
-		Scheme: partl.Scheme,
-		User:   partl.User,
-		Host:   partl.Host,
-		Path:   partl.Path,
-
-		// append api call
-	}).JoinPath("api", "print")
-
-	v := url.Values{
-		//	PFCount   uint
-		"pf": []string{fmt.Sprint(p.PFCount)},
-
-		//	LabelSize image.Point
-		"x": []string{fmt.Sprint(p.LabelSize.X)},
-		"y": []string{fmt.Sprint(p.LabelSize.Y)},
+	return base.JoinPath(append([]string{"api", "v1"}, p...)...), nil
+}
 
-		"ditherer": []string{string(p.Ditherer)},
+// request builds a request to the api, body is sent with contentType if not nil
+func (c *Client) request(ctx context.Context, method string, u *url.URL, contentType string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
 	}
 
-	es := []string{}
-	if p.Public {
-		v["public"] = es
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
 	}
 
-	if p.Resize {
-		v["resize"] = es
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
 	}
 
-	if p.Stretch {
-		v["stretch"] = es
-	}
+	return req, nil
+}
 
-	if p.Rotate {
-		v["rotate"] = es
+// do sends req and returns the response if its status is 2xx, otherwise an
+// *APIError
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
 	}
 
-	if p.Centerh {
-		v["centerh"] = es
-	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
 
-	if p.Centerv {
-		v["centerv"] = es
+		return nil, responseError(res)
 	}
 
-	if p.Tiling {
-		v["tiling"] = es
+	return res, nil
+}
+
+// doJSON sends in (if not nil) as json to the api path p and decodes the
+// response into out (if not nil)
+func (c *Client) doJSON(ctx context.Context, method string, in, out any, p ...string) error {
+	u, err := c.url(p...)
+	if err != nil {
+		return err
 	}
 
-	u.RawQuery = v.Encode()
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
 
-	h := http.Header{
-		"Accept":       []string{"application/json"},
-		"Content-Type": []string{"application/json"},
+		body = bytes.NewReader(b)
 	}
 
-	http.DefaultClient.Do(&http.Request{
-		Method: http.MethodPut,
-
-		URL: u,
+	req, err := c.request(ctx, method, u, "application/json", body)
+	if err != nil {
+		return err
+	}
 
-		Header: h,
+	return c.decode(req, out)
+}
 
-		Body:          readCloser(p.Image),
-		ContentLength: int64(len(p.Image)),
-	})
+func (c *Client) decode(req *http.Request, out any) error {
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
 
-	return
-}
+	defer res.Body.Close()
 
-type rc struct {
-	*bytes.Reader
-}
+	if out == nil {
+		return nil
+	}
 
-func readCloser(b []byte) *rc {
-	return &rc{bytes.NewReader(b)}
+	return json.NewDecoder(res.Body).Decode(out)
 }
 
-func (b *rc) Close() error {
-	b.Reader = nil
+// Print a printjob at host
+// host should only be the host, protocol and additional path part (the /api/v1 is appended automatically)
+//
+// Deprecated: use Client.Print, this does not authenticate unless host
+// contains a user and password
+func Print(host string, p *PrintJob) (jobid *uuid.UUID, err error) {
+	s, err := NewClient(host, "").Print(context.Background(), p)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return &s.JobID, nil
 }